@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/data"
+	"github.com/tomasen/realip"
+)
+
+// maxLoginDelay caps the delay enforced between failed logins for an email
+// address.
+const maxLoginDelay = time.Minute
+
+// loginAttempt is a login reserved by checkLoginAllowed. The stats are those
+// from before the attempt.
+type loginAttempt struct {
+	id    int64
+	stats *data.LoginAttemptStats
+}
+
+// checkLoginAllowed applies the brute-force protection policy to a login for
+// the email address, sending a 429 response and returning false if it must not
+// be attempted yet. After the first few failures each further attempt is
+// delayed, doubling every time, until the address is locked out altogether.
+// Failures are counted by address whether or not an account exists, so that
+// lockouts don't reveal which addresses are registered. An allowed attempt is
+// recorded as a failure straight away, before the slow password check, so
+// concurrent attempts can't exceed the limits; a successful login clears it.
+func (app *application) checkLoginAllowed(w http.ResponseWriter, r *http.Request, email string) (*loginAttempt, bool) {
+	cfg := app.config.bruteForce
+
+	var locked bool
+	var wait time.Duration
+
+	allow := func(stats *data.LoginAttemptStats) bool {
+		switch {
+		case stats.IPFailures >= cfg.ipMaxAttempts:
+			locked, wait = true, cfg.window
+		case stats.EmailFailures >= cfg.maxAttempts:
+			locked, wait = true, time.Until(stats.LastFailure.Add(cfg.window))
+		case stats.EmailFailures >= cfg.freeAttempts:
+			delay := loginDelay(stats.EmailFailures - cfg.freeAttempts)
+			wait = time.Until(stats.LastFailure.Add(delay))
+		}
+		return !locked && wait <= 0
+	}
+
+	id, stats, err := app.models.LoginAttempts.Reserve(email, realip.FromRequest(r), time.Now().Add(-cfg.window), allow)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	switch {
+	case locked:
+		app.loginLockedResponse(w, r, wait)
+		return nil, false
+	case id == 0:
+		app.loginDelayedResponse(w, r, wait)
+		return nil, false
+	}
+
+	return &loginAttempt{id: id, stats: stats}, true
+}
+
+// loginDelay returns the delay after n failures beyond the free attempts.
+func loginDelay(n int) time.Duration {
+	delay := time.Duration(math.Pow(2, float64(n))) * time.Second
+	if delay <= 0 || delay > maxLoginDelay {
+		return maxLoginDelay
+	}
+	return delay
+}
+
+// recordLoginFailure handles a failed login, which stays recorded as a failure.
+// The user is nil if no account exists. Attempts are reserved one at a time,
+// so exactly one reaches the limit; if it fails the address is locked and its
+// owner is emailed a link to unlock it.
+func (app *application) recordLoginFailure(r *http.Request, email string, attempt *loginAttempt, user *data.User) error {
+	if attempt.stats.EmailFailures+1 != app.config.bruteForce.maxAttempts {
+		return nil
+	}
+
+	// A login that succeeded in the meantime has cleared the failures.
+	exists, err := app.models.LoginAttempts.Exists(attempt.id)
+	if err != nil || !exists {
+		return err
+	}
+
+	if user == nil {
+		app.audit(r, data.AuditLockout, 0, map[string]interface{}{"email_hash": app.auditEmailHash(email)})
+		return nil
+	}
+
+	app.audit(r, data.AuditLockout, user.ID, nil)
+
+	token, err := app.models.Tokens.New(user.ID, app.config.bruteForce.window, data.ScopeUnlock)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"unlockToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_unlock.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err.Error(), nil)
+		}
+	})
+
+	return nil
+}
+
+// lockoutState describes the recent failed logins for an email address, for
+// showing to admins.
+func (app *application) lockoutState(email string) (map[string]interface{}, error) {
+	cfg := app.config.bruteForce
+
+	// No IP address is involved, so the IP failure count is left at zero.
+	stats, err := app.models.LoginAttempts.Stats(email, "", time.Now().Add(-cfg.window))
+	if err != nil {
+		return nil, err
+	}
+
+	var lockedUntil *time.Time
+	if stats.EmailFailures >= cfg.maxAttempts {
+		until := stats.LastFailure.Add(cfg.window)
+		lockedUntil = &until
+	}
+
+	return map[string]interface{}{
+		"failed_attempts": stats.EmailFailures,
+		"locked_until":    lockedUntil,
+	}, nil
+}
+
+func (app *application) loginDelayedResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	setRetryAfter(w, wait)
+	message := "too many failed login attempts, please wait before trying again"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) loginLockedResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	setRetryAfter(w, wait)
+	message := "too many failed login attempts, logging in is temporarily locked"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+// supportedEncodings is in order of server preference, used to break ties
+// between codings with the same quality value.
+var supportedEncodings = []string{encodingZstd, encodingGzip}
+
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+var zstdOptions = []zstd.EOption{zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault)}
+
+var compressorPools = map[string]*sync.Pool{
+	encodingGzip: {
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	},
+	encodingZstd: {
+		New: func() interface{} {
+			// NewWriter only fails on invalid options, and those have been
+			// checked by initCompressors at startup.
+			encoder, err := zstd.NewWriter(nil, zstdOptions...)
+			if err != nil {
+				panic(err)
+			}
+			return encoder
+		},
+	},
+}
+
+// initCompressors creates the first zstd encoder, so that a problem with it
+// stops the server at startup instead of failing requests.
+func initCompressors() error {
+	encoder, err := zstd.NewWriter(nil, zstdOptions...)
+	if err != nil {
+		return err
+	}
+
+	compressorPools[encodingZstd].Put(encoder)
+	return nil
+}
+
+// negotiateEncoding picks a content coding from an Accept-Encoding header, or
+// returns an empty string if the response should not be compressed.
+func negotiateEncoding(header string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(key)) == "q" {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil {
+					q = 0
+				} else {
+					q = parsed
+				}
+			}
+		}
+
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		qualities[coding] = q
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, coding := range supportedEncodings {
+		q, ok := qualities[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best = coding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// compressible reports whether responses with the given Content-Type benefit
+// from compression. Event streams are excluded so that each event reaches the
+// client as soon as it is flushed.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/msgpack":
+		return true
+	}
+
+	return false
+}
+
+// countingWriter counts the bytes that reach the underlying writer, i.e. the
+// compressed size of the response body.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// compressWriter buffers the start of a response body until either minSize
+// bytes have been written, the handler flushes, or the response is complete.
+// Only then is it decided whether to compress, so that small responses and
+// responses with an incompressible Content-Type are passed through unchanged.
+type compressWriter struct {
+	http.ResponseWriter
+	request  *http.Request
+	encoding string
+	minSize  int
+
+	status     int
+	buf        []byte
+	decided    bool
+	compressor compressor
+	counter    *countingWriter
+	bytesIn    int64
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+
+	// Informational responses are sent straight away and don't end the header.
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	cw.status = status
+
+	if !bodyAllowed(cw.request, status) {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		contentType := cw.Header().Get("Content-Type")
+		if contentType != "" && !compressible(contentType) {
+			cw.decide()
+		} else {
+			cw.buf = append(cw.buf, p...)
+			if len(cw.buf) >= cw.minSize {
+				err := cw.decide()
+				if err != nil {
+					return 0, err
+				}
+			}
+			return len(p), nil
+		}
+	}
+
+	if cw.compressor != nil {
+		cw.bytesIn += int64(len(p))
+		return cw.compressor.Write(p)
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// decide commits the response header and writes out anything buffered so far.
+func (cw *compressWriter) decide() error {
+	if cw.decided {
+		return nil
+	}
+	cw.decided = true
+
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	compress := len(cw.buf) >= cw.minSize &&
+		bodyAllowed(cw.request, cw.status) &&
+		header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == "" &&
+		compressible(header.Get("Content-Type"))
+
+	if compress {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+
+		cw.counter = &countingWriter{w: cw.ResponseWriter}
+		cw.compressor = compressorPools[cw.encoding].Get().(compressor)
+		cw.compressor.Reset(cw.counter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if cw.compressor != nil {
+		cw.bytesIn += int64(len(buf))
+		_, err := cw.compressor.Write(buf)
+		return err
+	}
+
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends any buffered data to the client, compressing it if the response
+// has been selected for compression.
+func (cw *compressWriter) Flush() {
+	cw.decide()
+
+	if cw.compressor != nil {
+		cw.compressor.Flush()
+	}
+
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close completes the response and returns the compressor to its pool.
+func (cw *compressWriter) Close() error {
+	if cw.status == 0 && len(cw.buf) == 0 {
+		// The handler never wrote anything; let net/http send its default
+		// response without our headers getting in the way.
+		cw.Header().Del("Content-Encoding")
+		return nil
+	}
+
+	err := cw.decide()
+	if cw.compressor != nil {
+		closeErr := cw.compressor.Close()
+		if err == nil {
+			err = closeErr
+		}
+		cw.compressor.Reset(nil)
+		compressorPools[cw.encoding].Put(cw.compressor)
+		cw.compressor = nil
+	}
+
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func bodyAllowed(r *http.Request, status int) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	if status >= 100 && status < 200 {
+		return false
+	}
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
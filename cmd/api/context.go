@@ -5,11 +5,18 @@ import (
 	"net/http"
 
 	"github.com/kcharymyrat/greenlight/internal/data"
+	"github.com/kcharymyrat/greenlight/internal/jwt"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	tokenContextKey  = contextKey("token")
+	claimsContextKey = contextKey("claims")
+	apiKeyContextKey = contextKey("apiKey")
+	oauthContextKey  = contextKey("oauth")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +30,58 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// contextSetToken stores the plaintext of the token the request was
+// authenticated with.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the token the request was authenticated with, or an
+// empty string for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// contextSetClaims stores the claims of the stateless token the request was
+// authenticated with.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// contextGetClaims returns the claims of the request's stateless token, or nil
+// if the request wasn't authenticated with one.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
+
+// contextSetAPIKey stores the API key the request was authenticated with.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the request's API key, or nil if the request wasn't
+// authenticated with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// contextSetOAuthGrant stores the grant of the OAuth access token the request
+// was authenticated with.
+func (app *application) contextSetOAuthGrant(r *http.Request, grant *data.OAuthGrant) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthContextKey, grant)
+	return r.WithContext(ctx)
+}
+
+// contextGetOAuthGrant returns the request's OAuth grant, or nil if the request
+// wasn't authenticated with an OAuth access token.
+func (app *application) contextGetOAuthGrant(r *http.Request) *data.OAuthGrant {
+	grant, _ := r.Context().Value(oauthContextKey).(*data.OAuthGrant)
+	return grant
+}
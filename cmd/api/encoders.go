@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The non-JSON encoders work on an ordered tree produced by round-tripping the
+// envelope through encoding/json. That way every format uses the same field
+// names, honors the same `json:"-"` tags and custom MarshalJSON methods (such as
+// data.Runtime), and keeps fields in the order the JSON output has them.
+
+type orderedField struct {
+	key   string
+	value interface{}
+}
+
+type orderedObject []orderedField
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// toOrdered converts v into a tree of orderedObject, []interface{}, string,
+// json.Number, bool and nil values.
+func toOrdered(v interface{}) (interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.UseNumber()
+
+	return decodeOrdered(decoder)
+}
+
+func decodeOrdered(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return token, nil
+	}
+
+	switch delim {
+	case '{':
+		obj := orderedObject{}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, orderedField{key: keyToken.(string), value: value})
+		}
+		_, err = decoder.Token()
+		return obj, err
+	case '[':
+		arr := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err = decoder.Token()
+		return arr, err
+	default:
+		return nil, errors.New("unexpected JSON delimiter")
+	}
+}
+
+func encodeJSON(data envelope, pretty bool) ([]byte, error) {
+	var js []byte
+	var err error
+
+	if pretty {
+		js, err = json.MarshalIndent(data, "", "  ")
+	} else {
+		js, err = json.Marshal(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append(js, '\n'), nil
+}
+
+// collectionKey returns the envelope key holding the collection of a list
+// response. An envelope is a collection if exactly one of its values is a slice
+// of structs or maps.
+func collectionKey(data envelope) (string, bool) {
+	found := ""
+
+	for key, value := range data {
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			continue
+		}
+
+		elem := rv.Type().Elem()
+		for elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct && elem.Kind() != reflect.Map {
+			continue
+		}
+
+		if found != "" {
+			return "", false
+		}
+		found = key
+	}
+
+	return found, found != ""
+}
+
+// encodeCSV writes the collection held in the envelope as CSV with a header row.
+// Other envelope values (such as pagination metadata) are not included.
+func encodeCSV(data envelope) ([]byte, error) {
+	key, ok := collectionKey(data)
+	if !ok {
+		return nil, errors.New("csv encoding requires a collection response")
+	}
+
+	tree, err := toOrdered(data[key])
+	if err != nil {
+		return nil, err
+	}
+	rows, _ := tree.([]interface{})
+
+	// Fields tagged omitempty may be missing from some rows, so the header is the
+	// union of keys in the order they are first seen.
+	var columns []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		obj, _ := row.(orderedObject)
+		for _, field := range obj {
+			if !seen[field.key] {
+				seen[field.key] = true
+				columns = append(columns, field.key)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	err = writer.Write(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		obj, _ := row.(orderedObject)
+		values := make(map[string]interface{}, len(obj))
+		for _, field := range obj {
+			values[field.key] = field.value
+		}
+
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i], err = csvValue(values[column])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = writer.Write(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i := range v {
+			part, err := csvValue(v[i])
+			if err != nil {
+				return "", err
+			}
+			parts[i] = part
+		}
+		return strings.Join(parts, ";"), nil
+	default:
+		js, err := json.Marshal(v)
+		return string(js), err
+	}
+}
+
+var xmlNameRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// encodeXML writes the envelope under a <response> root element. Object keys
+// become element names and array elements are written as <item> elements.
+func encodeXML(data envelope) ([]byte, error) {
+	tree, err := toOrdered(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+
+	err = writeXMLElement(encoder, "response", tree)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encoder.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func writeXMLElement(encoder *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+
+	// Keys that aren't valid XML names (validation errors can use arbitrary
+	// keys) are written as <item key="..."> instead.
+	if !xmlNameRx.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "xml") {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "item"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+
+	err := encoder.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case orderedObject:
+		for _, field := range v {
+			err = writeXMLElement(encoder, field.key, field.value)
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			err = writeXMLElement(encoder, "item", v[i])
+			if err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		text, err := csvValue(v)
+		if err != nil {
+			return err
+		}
+		err = encoder.EncodeToken(xml.CharData(text))
+		if err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+// encodeMsgpack writes the envelope using the MessagePack format
+// (https://github.com/msgpack/msgpack/blob/master/spec.md).
+func encodeMsgpack(data envelope) ([]byte, error) {
+	tree, err := toOrdered(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = writeMsgpack(&buf, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for i := range v {
+			err := writeMsgpack(buf, v[i])
+			if err != nil {
+				return err
+			}
+		}
+	case orderedObject:
+		writeMsgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, field := range v {
+			err := writeMsgpack(buf, field.key)
+			if err != nil {
+				return err
+			}
+			err = writeMsgpack(buf, field.value)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("msgpack: unsupported value type")
+	}
+
+	return nil
+}
+
+// writeMsgpackHeader writes the type and length prefix for strings, arrays and
+// maps. A zero code8 means the type has no 8-bit length variant.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fixCode byte, fixLimit int, code8, code16, code32 byte) {
+	switch {
+	case n < fixLimit:
+		buf.WriteByte(fixCode | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(code32)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(int16(i))))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(int32(i))))
+	default:
+		buf.WriteByte(0xd3)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kcharymyrat/greenlight/internal/data"
+)
+
+func testMovies() envelope {
+	return envelope{
+		"metadata": data.Metadata{CurrentPage: 1},
+		"movies": []*data.Movie{
+			{ID: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}, Version: 1},
+			{ID: 2, Title: "Black Panther, Part 1", Year: 2018, Genres: []string{"action"}, Version: 2},
+		},
+	}
+}
+
+func TestCollectionKey(t *testing.T) {
+	tests := []struct {
+		name string
+		data envelope
+		want string
+		ok   bool
+	}{
+		{"collection", testMovies(), "movies", true},
+		{"single record", envelope{"movie": &data.Movie{ID: 1}}, "", false},
+		{"string slice", envelope{"genres": []string{"drama"}}, "", false},
+		{"two collections", envelope{"a": []data.Movie{}, "b": []map[string]int{}}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := collectionKey(tt.data)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("collectionKey() = %q, %v; want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEncodeCSV(t *testing.T) {
+	got, err := encodeCSV(testMovies())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second movie has no runtime, so that column is empty for it.
+	want := "id,title,year,runtime,genres,version\n" +
+		"1,Moana,2016,107 mins,animation;adventure,1\n" +
+		"2,\"Black Panther, Part 1\",2018,,action,2\n"
+	if string(got) != want {
+		t.Errorf("encodeCSV() =\n%s\nwant\n%s", got, want)
+	}
+
+	_, err = encodeCSV(envelope{"movie": &data.Movie{ID: 1}})
+	if err == nil {
+		t.Error("encodeCSV() of a single record returned no error")
+	}
+}
+
+func TestEncodeXML(t *testing.T) {
+	got, err := encodeXML(envelope{
+		"movie":  &data.Movie{ID: 1, Title: "Up & Away", Genres: []string{"family"}},
+		"errors": map[string]string{"1st field": "must be provided"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"<response>",
+		"<title>Up &amp; Away</title>",
+		"<genres>\n      <item>family</item>\n    </genres>",
+		`<item key="1st field">must be provided</item>`,
+	} {
+		if !bytes.Contains(got, []byte(want)) {
+			t.Errorf("encodeXML() output is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	tests := []struct {
+		name string
+		data envelope
+		want []byte
+	}{
+		{
+			name: "scalars",
+			data: envelope{"a": 1, "b": true, "c": nil},
+			want: []byte{0x83, 0xa1, 'a', 0x01, 0xa1, 'b', 0xc3, 0xa1, 'c', 0xc0},
+		},
+		{
+			name: "negative and large integers",
+			data: envelope{"n": []int64{-1, -33, 200, 70000}},
+			want: []byte{0x81, 0xa1, 'n', 0x94, 0xff, 0xd0, 0xdf, 0xcc, 0xc8, 0xce, 0x00, 0x01, 0x11, 0x70},
+		},
+		{
+			name: "float",
+			data: envelope{"f": 1.5},
+			want: []byte{0x81, 0xa1, 'f', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeMsgpack(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("encodeMsgpack() = % x; want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeMsgpackLongString(t *testing.T) {
+	s := string(bytes.Repeat([]byte("x"), 40))
+
+	got, err := encodeMsgpack(envelope{"s": s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]byte{0x81, 0xa1, 's', 0xd9, 40}, s...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("encodeMsgpack() = % x; want % x", got, want)
+	}
+}
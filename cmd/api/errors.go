@@ -15,7 +15,16 @@ func (app *application) logError(r *http.Request, err error) {
 
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	errEnvelope := envelope{"error": message}
-	err := app.writeJSON(w, status, errEnvelope, nil)
+
+	// Error responses are never rejected with 406 Not Acceptable; if the client
+	// can't accept any supported format we fall back to JSON.
+	w.Header().Add("Vary", "Accept")
+	format, ok := negotiateFormat(r.Header.Get("Accept"), responseOffers(errEnvelope))
+	if !ok {
+		format = formatJSON
+	}
+
+	err := app.writeFormat(w, r, status, format, errEnvelope, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -67,6 +76,12 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+	message := "invalid or expired api key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -77,7 +92,22 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) deactivatedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been deactivated by an administrator"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) delegatedCredentialResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key or OAuth access token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested resource is not available in any of the accepted formats"
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
@@ -5,8 +5,6 @@ import (
 )
 
 func (app *application) healthcheckHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "application/json")
-
 	env := envelope{
 		"status": "available",
 		"system_info": map[string]string{
@@ -15,7 +13,7 @@ func (app *application) healthcheckHandler(writer http.ResponseWriter, request *
 		},
 	}
 
-	err := app.writeJSON(writer, http.StatusOK, env, nil)
+	err := app.writeResponse(writer, request, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(writer, request, err)
 	}
@@ -9,6 +9,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/kcharymyrat/greenlight/internal/validator"
@@ -25,24 +27,6 @@ func (app *application) readIdParam(r *http.Request) (int64, error) {
 	return id, err
 }
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	dataJSON, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return nil
-	}
-	dataJSON = append(dataJSON, '\n')
-
-	for key, value := range headers {
-		w.Header()[key] = value
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	w.Write(dataJSON)
-
-	return nil
-}
-
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	maxBytes := 1_048_576 // 1 MB
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
@@ -119,6 +103,89 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return resInt
 }
 
+// checkNotModified sets the caching headers for a GET or HEAD response and
+// reports whether the client's cached copy is still current according to its
+// If-None-Match or If-Modified-Since header. If so, a 304 Not Modified response
+// has already been sent and the caller should return.
+func (app *application) checkNotModified(w http.ResponseWriter, r *http.Request, lastModified time.Time, etag string) bool {
+	lastModified = lastModified.UTC().Truncate(time.Second)
+
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if app.config.httpCache.cacheControl != "" {
+		w.Header().Set("Cache-Control", app.config.httpCache.cacheControl)
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since (RFC 9110, 13.2.2).
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" || !etagMatches(ifNoneMatch, etag) {
+			return false
+		}
+	} else {
+		ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || lastModified.IsZero() || lastModified.After(ifModifiedSince) {
+			return false
+		}
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header matches the etag using
+// the weak comparison function.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readBool returns nil if the key is absent, so that callers can tell "not
+// filtered" apart from false.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	res := qs.Get(key)
+	if res == "" {
+		return nil
+	}
+
+	resBool, err := strconv.ParseBool(res)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+	return &resBool
+}
+
+// readTime parses an RFC 3339 timestamp, returning nil if the key is absent.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	res := qs.Get(key)
+	if res == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, res)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return nil
+	}
+	return &t
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 
@@ -134,3 +201,14 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
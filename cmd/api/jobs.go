@@ -0,0 +1,165 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/schedule"
+)
+
+// job is a piece of housekeeping run in the background on a schedule. run
+// returns the number of records it affected.
+type job struct {
+	name     string
+	spec     string
+	schedule schedule.Schedule
+	run      func() (int64, error)
+}
+
+// jobs returns the configured jobs. A job with an empty spec is disabled.
+func (app *application) jobs() ([]*job, error) {
+	cfg := app.config.jobs
+
+	all := []*job{
+		{name: "purge_expired_tokens", spec: cfg.purgeExpiredTokens, run: app.purgeExpiredTokens},
+		{name: "purge_deleted_users", spec: cfg.purgeDeletedUsers, run: app.models.Users.DeleteScheduled},
+		{name: "purge_audit_events", spec: cfg.purgeAuditEvents, run: app.purgeAuditEvents},
+	}
+	if cfg.unactivatedUserDays > 0 {
+		all = append(all, &job{name: "purge_unactivated_users", spec: cfg.purgeUnactivatedUsers, run: app.purgeUnactivatedUsers})
+	}
+
+	var jobs []*job
+
+	for _, j := range all {
+		if j.spec == "" {
+			continue
+		}
+
+		var err error
+		j.schedule, err = schedule.Parse(j.spec)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %w", j.name, err)
+		}
+
+		jobs = append(jobs, j)
+	}
+
+	return jobs, nil
+}
+
+// startJobs runs each of the jobs on its schedule until stop is closed. Jobs
+// are tracked by app.wg, so a shutdown waits for a running job to finish.
+func (app *application) startJobs(jobs []*job, stop <-chan struct{}) {
+	m := jobMetrics{
+		runs:     expvar.NewMap("job_runs"),
+		failures: expvar.NewMap("job_failures"),
+		records:  expvar.NewMap("job_records_affected"),
+		duration: expvar.NewMap("job_processing_time_microsecs"),
+		lastRun:  expvar.NewMap("job_last_run"),
+	}
+
+	for _, j := range jobs {
+		app.background(func() {
+			app.runJob(j, m, stop)
+		})
+	}
+}
+
+type jobMetrics struct {
+	runs, failures, records, duration, lastRun *expvar.Map
+}
+
+func (app *application) runJob(j *job, m jobMetrics, stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(time.Until(j.schedule.Next(time.Now())))
+
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		start := time.Now()
+		count, err := j.safeRun()
+		duration := time.Since(start)
+
+		m.runs.Add(j.name, 1)
+		m.duration.Add(j.name, duration.Microseconds())
+
+		lastRun := new(expvar.String)
+		lastRun.Set(start.UTC().Format(time.RFC3339))
+		m.lastRun.Set(j.name, lastRun)
+
+		properties := map[string]string{
+			"job":      j.name,
+			"duration": duration.String(),
+		}
+
+		if err != nil {
+			m.failures.Add(j.name, 1)
+			properties["error"] = err.Error()
+			app.logger.PrintError("job failed", properties)
+			continue
+		}
+
+		m.records.Add(j.name, count)
+		properties["count"] = strconv.FormatInt(count, 10)
+		app.logger.PrintInfo("job completed", properties)
+	}
+}
+
+// safeRun runs the job, turning a panic into an error so that it is counted as
+// a failure and the job keeps to its schedule.
+func (j *job) safeRun() (count int64, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+
+	return j.run()
+}
+
+// purgeExpiredTokens removes tokens, revocations, authorization codes and
+// failed login attempts that no longer have any effect.
+func (app *application) purgeExpiredTokens() (int64, error) {
+	var total int64
+
+	for _, purge := range []func() (int64, error){
+		app.models.Tokens.DeleteExpired,
+		app.models.Revocations.DeleteExpired,
+		app.models.OAuth.DeleteExpiredCodes,
+		func() (int64, error) {
+			return app.models.LoginAttempts.DeleteOlderThan(time.Now().Add(-app.config.bruteForce.window))
+		},
+	} {
+		count, err := purge()
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+
+	return total, nil
+}
+
+// purgeUnactivatedUsers removes accounts that were never activated.
+func (app *application) purgeUnactivatedUsers() (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -app.config.jobs.unactivatedUserDays)
+	return app.models.Users.DeleteUnactivated(cutoff)
+}
+
+// purgeAuditEvents removes audit events older than the retention period and
+// pseudonymises the events of deleted users. Events are kept forever if the
+// retention period is 0, but are still pseudonymised.
+func (app *application) purgeAuditEvents() (int64, error) {
+	var cutoff time.Time
+	if days := app.config.jobs.auditRetentionDays; days > 0 {
+		cutoff = time.Now().AddDate(0, 0, -days)
+	}
+	return app.models.Audit.Purge(cutoff)
+}
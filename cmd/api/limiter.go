@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// keyedLimiter is a set of token bucket rate limiters, one per key, for
+// limiting requests by something other than the client IP address (such as the
+// email address a request is about). Limiters that haven't been used for a
+// while are dropped.
+type keyedLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*keyedLimiterEntry
+}
+
+type keyedLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(limit rate.Limit, burst int) *keyedLimiter {
+	l := &keyedLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[string]*keyedLimiterEntry),
+	}
+
+	// An idle limiter is dropped once it would have refilled completely, at
+	// which point a new one behaves identically.
+	idle := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			l.mu.Lock()
+			for key, entry := range l.limiters {
+				if time.Since(entry.lastSeen) > idle {
+					delete(l.limiters, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+func (l *keyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, found := l.limiters[key]
+	if !found {
+		entry = &keyedLimiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = time.Now()
+
+	return entry.limiter.Allow()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/data"
+	"github.com/lib/pq"
+)
+
+// listenForInvalidations subscribes to the PostgreSQL NOTIFY channels used to
+// keep the in-process caches of every instance consistent. The listener is
+// closed once stop is closed.
+func (app *application) listenForInvalidations(stop <-chan struct{}) error {
+	reportProblem := func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err.Error(), map[string]string{"component": "listener"})
+		}
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, reportProblem)
+
+	var channels []string
+	if app.models.Movies.Cache != nil {
+		channels = append(channels, data.MovieInvalidationChannel)
+	}
+	if app.models.Users.Cache != nil {
+		channels = append(channels, data.AuthInvalidationChannel)
+	}
+	if app.signer != nil {
+		channels = append(channels, data.RevocationChannel)
+	}
+
+	for _, channel := range channels {
+		err := listener.Listen(channel)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	app.background(func() {
+		defer listener.Close()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case n := <-listener.Notify:
+				app.handleNotification(n)
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	})
+
+	return nil
+}
+
+// handleNotification applies a single notification to the caches. A panic is
+// recovered and logged here so that it doesn't stop the listener loop.
+func (app *application) handleNotification(n *pq.Notification) {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.PrintError(fmt.Sprintf("%s", err), map[string]string{"component": "listener"})
+		}
+	}()
+
+	// A nil notification is sent after the connection was re-established, in
+	// which case notifications may have been missed and the whole cache must
+	// be dropped.
+	if n == nil {
+		app.purgeCaches()
+		if app.signer != nil {
+			app.reloadDenylist()
+		}
+		return
+	}
+
+	if n.Channel == data.RevocationChannel {
+		app.reloadDenylist()
+		return
+	}
+
+	if n.Channel == data.AuthInvalidationChannel && n.Extra == "*" {
+		app.models.Users.Cache.Purge()
+		return
+	}
+
+	id, err := strconv.ParseInt(n.Extra, 10, 64)
+	if err != nil {
+		app.logger.PrintError(err.Error(), map[string]string{"channel": n.Channel})
+		return
+	}
+
+	switch n.Channel {
+	case data.MovieInvalidationChannel:
+		app.models.Movies.Cache.Invalidate(id)
+	case data.AuthInvalidationChannel:
+		app.models.Users.Cache.InvalidateUser(id)
+	}
+}
+
+func (app *application) purgeCaches() {
+	if app.models.Movies.Cache != nil {
+		app.models.Movies.Cache.Purge()
+	}
+	if app.models.Users.Cache != nil {
+		app.models.Users.Cache.Purge()
+	}
+}
+
+func (app *application) reloadDenylist() {
+	err := app.models.Revocations.Load()
+	if err != nil {
+		app.logger.PrintError(err.Error(), map[string]string{"component": "denylist"})
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"runtime"
 	"strconv"
@@ -16,8 +18,12 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/kcharymyrat/greenlight/internal/data"
 	"github.com/kcharymyrat/greenlight/internal/jsonlog"
+	"github.com/kcharymyrat/greenlight/internal/jwt"
 	"github.com/kcharymyrat/greenlight/internal/mailer"
+	"github.com/kcharymyrat/greenlight/internal/passhash"
+	"github.com/kcharymyrat/greenlight/internal/passpolicy"
 	_ "github.com/lib/pq"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -49,6 +55,76 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	compress struct {
+		enabled bool
+		minSize int
+	}
+	cache struct {
+		enabled bool
+		size    int
+		ttl     time.Duration
+	}
+	authCache struct {
+		enabled bool
+		size    int
+		ttl     time.Duration
+	}
+	httpCache struct {
+		cacheControl string
+	}
+	accountDeletion struct {
+		gracePeriod time.Duration
+	}
+	roles struct {
+		defaultRole string
+	}
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	jwt struct {
+		keys string
+		ttl  time.Duration
+	}
+	audit struct {
+		emailKey string
+	}
+	magicLink struct {
+		interval time.Duration
+		burst    int
+	}
+	oauth struct {
+		tokenTTL time.Duration
+	}
+	jobs struct {
+		purgeExpiredTokens    string
+		purgeDeletedUsers     string
+		purgeUnactivatedUsers string
+		unactivatedUserDays   int
+		purgeAuditEvents      string
+		auditRetentionDays    int
+	}
+	passwords struct {
+		algorithm         string
+		bcryptCost        int
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+	}
+	passwordPolicy struct {
+		minLength    int
+		breachedFile string
+	}
+	privacy struct {
+		enabled         bool
+		minResponseTime time.Duration
+	}
+	bruteForce struct {
+		freeAttempts  int
+		maxAttempts   int
+		window        time.Duration
+		ipMaxAttempts int
+	}
 }
 
 type application struct {
@@ -56,7 +132,11 @@ type application struct {
 	logger *jsonlog.Logger
 	models data.Models
 	mailer mailer.Mailer
+	signer *jwt.Signer
 	wg     sync.WaitGroup
+
+	// magicLinks limits how often login links are sent to each address.
+	magicLinks *keyedLimiter
 }
 
 func main() {
@@ -94,6 +174,59 @@ func main() {
 		return nil
 	})
 
+	flag.BoolVar(&cfg.compress.enabled, "compress-enabled", true, "Enable gzip/zstd response compression")
+	flag.IntVar(&cfg.compress.minSize, "compress-min-size", 1024, "Minimum response size in bytes before compression is applied")
+
+	flag.BoolVar(&cfg.cache.enabled, "cache-enabled", true, "Enable the in-process movie cache")
+	flag.IntVar(&cfg.cache.size, "cache-size", 10_000, "Maximum number of movies held in the cache")
+	flag.DurationVar(&cfg.cache.ttl, "cache-ttl", 5*time.Minute, "Time-to-live of cached movies")
+
+	flag.BoolVar(&cfg.authCache.enabled, "auth-cache-enabled", true, "Enable caching of authentication tokens and permissions")
+	flag.IntVar(&cfg.authCache.size, "auth-cache-size", 10_000, "Maximum number of entries in each authentication cache")
+	flag.DurationVar(&cfg.authCache.ttl, "auth-cache-ttl", 30*time.Second, "Time-to-live of cached tokens and permissions")
+
+	flag.StringVar(&cfg.httpCache.cacheControl, "cache-control", "private, max-age=60", "Cache-Control header for cacheable movie responses")
+
+	flag.DurationVar(&cfg.accountDeletion.gracePeriod, "account-deletion-grace-period", 30*24*time.Hour, "Time before a deleted account is permanently removed")
+
+	flag.StringVar(&cfg.roles.defaultRole, "default-role", "reader", "Role assigned to newly registered users (empty for none)")
+
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+
+	flag.StringVar(&cfg.jwt.keys, "jwt-keys", cfg.jwt.keys, "Keys for signing stateless tokens as space separated kid:secret pairs, current key first (empty to disable)")
+	flag.DurationVar(&cfg.jwt.ttl, "jwt-ttl", 15*time.Minute, "Lifetime of stateless tokens")
+
+	flag.DurationVar(&cfg.magicLink.interval, "magic-link-interval", 5*time.Minute, "Time for one more login link to become available per address")
+	flag.IntVar(&cfg.magicLink.burst, "magic-link-burst", 3, "Number of login links that can be sent to an address at once")
+
+	flag.DurationVar(&cfg.oauth.tokenTTL, "oauth-token-ttl", time.Hour, "Lifetime of OAuth access tokens")
+
+	flag.IntVar(&cfg.bruteForce.freeAttempts, "login-free-attempts", 3, "Failed logins allowed for an email address before each further attempt is delayed")
+	flag.IntVar(&cfg.bruteForce.maxAttempts, "login-max-attempts", 10, "Failed logins after which an email address is locked")
+	flag.DurationVar(&cfg.bruteForce.window, "login-window", time.Hour, "Period failed logins are counted over, and how long a lockout lasts")
+	flag.IntVar(&cfg.bruteForce.ipMaxAttempts, "login-ip-max-attempts", 100, "Failed logins after which an IP address is blocked from logging in")
+
+	flag.StringVar(&cfg.passwords.algorithm, "password-algorithm", passhash.DefaultParams.Algorithm, "Algorithm for hashing passwords (argon2id|bcrypt)")
+	flag.IntVar(&cfg.passwords.bcryptCost, "bcrypt-cost", passhash.DefaultParams.BcryptCost, "Cost of bcrypt password hashes")
+	flag.UintVar(&cfg.passwords.argon2Memory, "argon2-memory", uint(passhash.DefaultParams.Memory), "Memory used by argon2id password hashing, in KiB")
+	flag.UintVar(&cfg.passwords.argon2Iterations, "argon2-iterations", uint(passhash.DefaultParams.Iterations), "Iterations of argon2id password hashing")
+	flag.UintVar(&cfg.passwords.argon2Parallelism, "argon2-parallelism", uint(passhash.DefaultParams.Parallelism), "Threads used by argon2id password hashing")
+
+	flag.IntVar(&cfg.passwordPolicy.minLength, "password-min-length", 8, "Minimum number of characters in new passwords")
+	flag.StringVar(&cfg.passwordPolicy.breachedFile, "breached-passwords-file", "", "Sorted file of SHA-1 hashes of breached passwords, which are refused as new passwords (empty to disable)")
+
+	flag.BoolVar(&cfg.privacy.enabled, "privacy-mode", false, "Answer registration, activation and password reset requests identically whether or not the email address is registered")
+	flag.DurationVar(&cfg.privacy.minResponseTime, "privacy-min-response-time", 500*time.Millisecond, "Minimum response time for requests answered identically in privacy mode")
+
+	flag.StringVar(&cfg.jobs.purgeExpiredTokens, "job-purge-expired-tokens", "*/15 * * * *", "Schedule for deleting expired tokens (empty to disable)")
+	flag.StringVar(&cfg.jobs.purgeDeletedUsers, "job-purge-deleted-users", "@hourly", "Schedule for deleting accounts whose deletion grace period has passed (empty to disable)")
+	flag.StringVar(&cfg.jobs.purgeUnactivatedUsers, "job-purge-unactivated-users", "0 3 * * *", "Schedule for deleting accounts left unactivated (empty to disable)")
+	flag.IntVar(&cfg.jobs.unactivatedUserDays, "unactivated-user-days", 30, "Days after which an account that was never activated is deleted (0 to keep forever)")
+	flag.StringVar(&cfg.jobs.purgeAuditEvents, "job-purge-audit-events", "30 3 * * *", "Schedule for deleting old audit events and pseudonymising those of deleted users (empty to disable)")
+	flag.IntVar(&cfg.jobs.auditRetentionDays, "audit-retention-days", 365, "Days after which audit events are deleted (0 to keep forever)")
+	flag.StringVar(&cfg.audit.emailKey, "audit-email-key", cfg.audit.emailKey, "Secret key for pseudonymising email addresses in the audit log, at least 32 bytes")
+
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -131,12 +264,124 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	models := data.NewModel(db)
+	if cfg.cache.enabled {
+		models.Movies.Cache = data.NewMovieCache(cfg.cache.size, cfg.cache.ttl)
+
+		// Publish the movie cache hit, miss and eviction counters
+		expvar.Publish("movie_cache", expvar.Func(func() interface{} {
+			return models.Movies.Cache.Stats()
+		}))
+	}
+
+	if cfg.authCache.enabled {
+		authCache := data.NewAuthCache(cfg.authCache.size, cfg.authCache.ttl)
+		models.Users.Cache = authCache
+		models.Tokens.Cache = authCache
+		models.Permissions.Cache = authCache
+		models.Roles.Cache = authCache
+
+		// Publish the token and permission cache hit rates
+		expvar.Publish("auth_cache", expvar.Func(func() interface{} {
+			return authCache.Stats()
+		}))
+	}
+
 	// Dependency Injection
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModel(db),
+		models: models,
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+
+		magicLinks: newKeyedLimiter(rate.Every(cfg.magicLink.interval), cfg.magicLink.burst),
+	}
+
+	// Passwords are hashed with these parameters from now on. Hashes made with
+	// other parameters are upgraded as users log in.
+	if cfg.passwords.argon2Memory > math.MaxUint32 || cfg.passwords.argon2Iterations > math.MaxUint32 {
+		logger.PrintFatal(errors.New("argon2-memory and argon2-iterations must be at most 4294967295"), nil)
+	}
+	if cfg.passwords.argon2Parallelism > math.MaxUint8 {
+		logger.PrintFatal(errors.New("argon2-parallelism must be at most 255"), nil)
+	}
+	data.PasswordParams = passhash.Params{
+		Algorithm:   cfg.passwords.algorithm,
+		BcryptCost:  cfg.passwords.bcryptCost,
+		Memory:      uint32(cfg.passwords.argon2Memory),
+		Iterations:  uint32(cfg.passwords.argon2Iterations),
+		Parallelism: uint8(cfg.passwords.argon2Parallelism),
+	}
+	err = data.PasswordParams.Validate()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.roles.defaultRole != "" {
+		_, err = models.Roles.GetByName(cfg.roles.defaultRole)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				err = fmt.Errorf("default-role %q does not exist", cfg.roles.defaultRole)
+			}
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if cfg.compress.minSize < 0 {
+		logger.PrintFatal(errors.New("compress-min-size must not be negative"), nil)
+	}
+	if cfg.compress.enabled {
+		err = initCompressors()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	if len(cfg.audit.emailKey) < 32 {
+		logger.PrintFatal(errors.New("audit-email-key must be at least 32 bytes"), nil)
+	}
+
+	if cfg.bruteForce.freeAttempts < 1 {
+		logger.PrintFatal(errors.New("login-free-attempts must be at least 1"), nil)
+	}
+	if cfg.bruteForce.maxAttempts <= cfg.bruteForce.freeAttempts {
+		logger.PrintFatal(errors.New("login-max-attempts must be greater than login-free-attempts"), nil)
+	}
+	if cfg.bruteForce.ipMaxAttempts < 1 {
+		logger.PrintFatal(errors.New("login-ip-max-attempts must be at least 1"), nil)
+	}
+	if cfg.bruteForce.window <= 0 {
+		logger.PrintFatal(errors.New("login-window must be positive"), nil)
+	}
+
+	if cfg.passwordPolicy.minLength < 8 {
+		logger.PrintFatal(errors.New("password-min-length must be at least 8"), nil)
+	}
+	data.PasswordPolicy.MinLength = cfg.passwordPolicy.minLength
+
+	if cfg.passwordPolicy.breachedFile != "" {
+		data.PasswordPolicy.Breached, err = passpolicy.OpenHashFile(cfg.passwordPolicy.breachedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer data.PasswordPolicy.Breached.Close()
+	}
+
+	if cfg.jwt.keys != "" {
+		keys, err := jwt.ParseKeys(cfg.jwt.keys)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		app.signer, err = jwt.New(keys)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		err = models.Revocations.Load()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
 	}
 
 	err = app.serve()
@@ -209,6 +454,11 @@ func setConfigWithEnvVars(cfg *config, logger *jsonlog.Logger) {
 
 	corsTrustedOrigins := os.Getenv("CORS_TRUSTED_ORIGINS")
 
+	// Stateless tokens are optional, so the keys may be left unset.
+	jwtKeys := os.Getenv("GREENLIGHT_JWT_KEYS")
+
+	auditEmailKey := os.Getenv("GREENLIGHT_AUDIT_EMAIL_KEY")
+
 	cfg.db.dsn = dsn
 	cfg.db.maxOpenConns = maxOpenConns
 	cfg.db.maxIdleConns = maxIdleConns
@@ -219,6 +469,8 @@ func setConfigWithEnvVars(cfg *config, logger *jsonlog.Logger) {
 	cfg.smtp.password = mailTrapPassword
 	cfg.smtp.sender = mailTrapSender
 	cfg.cors.trustedOrigins = strings.Fields(corsTrustedOrigins)
+	cfg.jwt.keys = jwtKeys
+	cfg.audit.emailKey = auditEmailKey
 }
 
 func openDB(cfg config) (*sql.DB, error) {
@@ -12,6 +12,7 @@ import (
 
 	"github.com/felixge/httpsnoop"
 	"github.com/kcharymyrat/greenlight/internal/data"
+	"github.com/kcharymyrat/greenlight/internal/jwt"
 	"github.com/kcharymyrat/greenlight/internal/validator"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
@@ -82,21 +83,39 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			app.authenticateAPIKey(w, r, next, key)
+			return
+		}
+
+		// OAuth clients authenticate to the /oauth endpoints with HTTP Basic
+		// authentication, which those handlers check themselves.
 		authorizationHeader := r.Header.Get("Authorization")
-		if authorizationHeader == "" {
+		if authorizationHeader == "" || strings.HasPrefix(authorizationHeader, "Basic ") {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
 		token := headerParts[1]
+
+		if app.signer != nil && jwt.LooksLikeToken(token) {
+			app.authenticateStateless(w, r, next, token)
+			return
+		}
+
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
@@ -107,18 +126,135 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+				app.authenticateOAuth(w, r, next, token)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
 
+		app.background(func() {
+			err := app.models.Tokens.Touch(token)
+			if err != nil {
+				app.logger.PrintError(err.Error(), nil)
+			}
+		})
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateStateless authenticates the request from a signed token without
+// querying the database. The user in the request context only carries the
+// fields held in the token's claims.
+func (app *application) authenticateStateless(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	claims, err := app.signer.Verify(token)
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	if app.models.Revocations.Denylist.IsRevoked(claims.ID, claims.Subject, time.Unix(claims.IssuedAt, 0)) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user := &data.User{
+		ID:        claims.Subject,
+		Name:      claims.Name,
+		Email:     claims.Email,
+		Activated: claims.Activated,
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetClaims(r, claims)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateAPIKey authenticates the request as the owner of an API key. The
+// key's permissions are kept in the request context so that the request is
+// limited to them.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.background(func() {
+		err := app.models.APIKeys.Touch(key.ID)
+		if err != nil {
+			app.logger.PrintError(err.Error(), nil)
+		}
+	})
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
+// authenticateOAuth authenticates the request with an access token issued to
+// an OAuth client. It is tried after the token didn't match an authentication
+// token, since both kinds share the same format.
+func (app *application) authenticateOAuth(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	user, grant, err := app.models.OAuth.GetForAccessToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetOAuthGrant(r, grant)
+	next.ServeHTTP(w, r)
+}
+
+// loadUser replaces the partial user of a statelessly authenticated request
+// with the full database record, for handlers that need fields such as the
+// password hash or version.
+func (app *application) loadUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := app.contextGetClaims(r)
+		if claims == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.models.Users.Get(claims.Subject)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = app.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	}
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -146,11 +282,58 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// requireAccountCredentials rejects requests made with a delegated credential.
+// It guards the routes that manage the account itself, which an API key or
+// OAuth access token must not reach whatever permissions it carries.
+func (app *application) requireAccountCredentials(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.delegatedRequest(r) {
+			app.delegatedCredentialResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// delegatedRequest reports whether the request was made with a credential that
+// only carries part of the user's authority, an API key or OAuth access token.
+// Such credentials can't be used to manage the account or mint further
+// credentials.
+func (app *application) delegatedRequest(r *http.Request) bool {
+	return app.contextGetAPIKey(r) != nil || app.contextGetOAuthGrant(r) != nil
+}
+
+// permissionsForRequest returns the permissions held by the user making the
+// request.
+func (app *application) permissionsForRequest(r *http.Request) (data.Permissions, error) {
+	// Stateless tokens carry the permissions the user had when the token was
+	// issued.
+	if claims := app.contextGetClaims(r); claims != nil {
+		return data.Permissions(claims.Permissions), nil
+	}
+
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A request made with an API key or OAuth access token is limited to its
+	// scope, and to what the user is still allowed to do.
+	if key := app.contextGetAPIKey(r); key != nil {
+		return key.Permissions.Intersect(permissions), nil
+	}
+	if grant := app.contextGetOAuthGrant(r); grant != nil {
+		return grant.Permissions.Intersect(permissions), nil
+	}
+
+	return permissions, nil
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.permissionsForRequest(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -167,6 +350,58 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// requireMovieWriteAccess allows the request if the user holds "movies:write",
+// or if they own or collaborate on the movie identified by the "id" URL
+// parameter. It must be wrapped by requirePermission("movies:write:own", ...).
+func (app *application) requireMovieWriteAccess(next http.HandlerFunc) http.HandlerFunc {
+	return app.authorizeMovie(true, next)
+}
+
+// requireMovieOwnership is like requireMovieWriteAccess but doesn't admit
+// collaborators, for actions such as managing the collaborators themselves.
+func (app *application) requireMovieOwnership(next http.HandlerFunc) http.HandlerFunc {
+	return app.authorizeMovie(false, next)
+}
+
+func (app *application) authorizeMovie(allowCollaborators bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		permissions, err := app.permissionsForRequest(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if permissions.Include("movies:write") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := app.readIdParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		access, err := app.models.Movies.GetAccess(id, app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !access.Owner && !(allowCollaborators && access.Collaborator) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
@@ -217,3 +452,60 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
 	})
 }
+
+func (app *application) compress(next http.Handler) http.Handler {
+	bytesIn := expvar.NewMap("compression_bytes_in")
+	bytesOut := expvar.NewMap("compression_bytes_out")
+	totalResponsesCompressed := expvar.NewMap("total_responses_compressed")
+
+	// Publish the compression ratio (uncompressed / compressed size) for each
+	// encoding.
+	expvar.Publish("compression_ratio", expvar.Func(func() interface{} {
+		ratios := make(map[string]float64)
+		for _, encoding := range supportedEncodings {
+			in, _ := bytesIn.Get(encoding).(*expvar.Int)
+			out, _ := bytesOut.Get(encoding).(*expvar.Int)
+			if in != nil && out != nil && out.Value() > 0 {
+				ratios[encoding] = float64(in.Value()) / float64(out.Value())
+			}
+		}
+		return ratios
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.compress.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			request:        r,
+			encoding:       encoding,
+			minSize:        app.config.compress.minSize,
+		}
+
+		defer func() {
+			err := cw.Close()
+			if err != nil {
+				app.logError(r, err)
+			}
+
+			if cw.counter != nil {
+				bytesIn.Add(encoding, cw.bytesIn)
+				bytesOut.Add(encoding, cw.counter.n)
+				totalResponsesCompressed.Add(encoding, 1)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/kcharymyrat/greenlight/internal/data"
 	"github.com/kcharymyrat/greenlight/internal/validator"
 )
@@ -24,10 +27,11 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: app.contextGetUser(r).ID,
 	}
 
 	v := validator.New()
@@ -46,7 +50,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("v1/movies/%d", movie.ID))
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -72,7 +76,11 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 
 	fmt.Println("movie =", movie)
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if app.checkNotModified(w, r, movie.UpdatedAt, "") {
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -141,7 +149,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -165,7 +173,7 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": fmt.Sprintf("moview with id = %d was successfully deleted", id)}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": fmt.Sprintf("moview with id = %d was successfully deleted", id)}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -197,6 +205,31 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Every page of the list changes whenever any movie is inserted, updated or
+	// deleted, so both validators are derived from the time of the last change
+	// to the movies table. The ETag also includes the negotiated format, as
+	// each format is a different representation of the same page.
+	changedAt, err := app.models.Movies.LastChanged()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	format, _ := negotiateFormat(r.Header.Get("Accept"), supportedFormats)
+	etag := fmt.Sprintf(`W/"%d-%s"`, changedAt.UnixNano(), format)
+
+	// Last-Modified only has a resolution of one second, so it is withheld
+	// until the second of the last change has passed. Otherwise a second change
+	// within the same second would be hidden from If-Modified-Since.
+	lastModified := changedAt
+	if time.Since(changedAt) < time.Second {
+		lastModified = time.Time{}
+	}
+
+	if app.checkNotModified(w, r, lastModified, etag) {
+		return
+	}
+
 	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -208,9 +241,94 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		"movies":   movies,
 	}
 
-	err = app.writeJSON(w, http.StatusOK, resEnvelope, nil)
+	err = app.writeResponse(w, r, http.StatusOK, resEnvelope, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) listMovieCollaboratorsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	collaborators, err := app.models.Movies.GetCollaborators(id)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"collaborators": collaborators}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addMovieCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		UserID int64 `json:"user_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.UserID > 0, "user_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Movies.AddCollaborator(id, input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("user_id", "no matching user found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.listMovieCollaboratorsHandler(w, r)
+}
+
+func (app *application) removeMovieCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || userID < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Movies.RemoveCollaborator(id, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.listMovieCollaboratorsHandler(w, r)
 }
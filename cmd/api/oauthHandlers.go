@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/data"
+	"github.com/kcharymyrat/greenlight/internal/validator"
+)
+
+// oauthCodeTTL is how long an authorization code can be exchanged for.
+const oauthCodeTTL = 10 * time.Minute
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	clients, err := app.models.OAuth.GetClientsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createOAuthClientHandler registers an OAuth client owned by the user. The
+// client can only ever be granted scopes the owner holds. A confidential
+// client's secret is only included in this response.
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		Name:         input.Name,
+		UserID:       user.ID,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       data.Permissions(input.Scopes),
+		Confidential: input.Confidential,
+	}
+
+	v := validator.New()
+
+	data.ValidateOAuthClient(v, client)
+	if !app.validatePermissionCodes(w, r, v, "scopes", client.Scopes) {
+		return
+	}
+
+	permissions, err := app.permissionsForRequest(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, code := range client.Scopes {
+		v.Check(permissions.Include(code), "scopes", "must only contain permissions you hold")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuth.InsertClient(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditOAuthClientCreated, user.ID, map[string]interface{}{"oauth_client_id": client.ID, "name": client.Name, "scopes": client.Scopes, "confidential": client.Confidential})
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.OAuth.DeleteClient(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditOAuthClientDeleted, user.ID, map[string]interface{}{"oauth_client_id": id})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizationRequest holds the parameters of a request to /oauth/authorize
+// (RFC 6749 section 4.1.1, with PKCE from RFC 7636).
+type authorizationRequest struct {
+	client        *data.OAuthClient
+	redirectURI   string
+	scopes        data.Permissions
+	state         string
+	codeChallenge string
+}
+
+// readAuthorizationRequest validates the parameters of an authorization
+// request. Until the client and redirect URI are known to be valid, errors are
+// sent to the user agent; after that they are returned to be passed on to the
+// client through a redirect, as RFC 6749 section 4.1.2.1 requires.
+func (app *application) readAuthorizationRequest(w http.ResponseWriter, r *http.Request) (*authorizationRequest, string, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, "", false
+	}
+
+	v := validator.New()
+
+	client, err := app.models.OAuth.GetClient(r.Form.Get("client_id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "unknown client")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, "", false
+	}
+
+	redirectURI := r.Form.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		v.AddError("redirect_uri", "must match a redirect uri registered for the client")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, "", false
+	}
+
+	req := &authorizationRequest{
+		client:        client,
+		redirectURI:   redirectURI,
+		state:         r.Form.Get("state"),
+		codeChallenge: r.Form.Get("code_challenge"),
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		return req, "unsupported_response_type", true
+	}
+
+	// PKCE is required for every client, and only the S256 method is allowed.
+	if r.Form.Get("code_challenge_method") != "S256" || len(req.codeChallenge) != 43 {
+		return req, "invalid_request", true
+	}
+
+	req.scopes = client.Scopes
+	if scope := r.Form.Get("scope"); scope != "" {
+		req.scopes = data.Permissions(strings.Fields(scope))
+		for _, code := range req.scopes {
+			if !slices.Contains(client.Scopes, code) {
+				return req, "invalid_scope", true
+			}
+		}
+	}
+
+	return req, "", true
+}
+
+// showAuthorizationHandler describes an authorization request, so that the
+// front end can ask the user for their consent.
+func (app *application) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	req, oauthErr, ok := app.readAuthorizationRequest(w, r)
+	if !ok {
+		return
+	}
+	if oauthErr != "" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, oauthErr, "invalid authorization request")
+		return
+	}
+
+	env := envelope{"authorization": map[string]interface{}{
+		"client": map[string]string{
+			"client_id": req.client.ClientID,
+			"name":      req.client.Name,
+		},
+		"redirect_uri": req.redirectURI,
+		"scopes":       req.scopes,
+		"state":        req.state,
+	}}
+
+	err := app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizeHandler records the user's decision on an authorization request
+// and redirects back to the client, with an authorization code if the user
+// approved.
+func (app *application) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	req, oauthErr, ok := app.readAuthorizationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	redirect, err := url.Parse(req.redirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	query := redirect.Query()
+	if req.state != "" {
+		query.Set("state", req.state)
+	}
+
+	if oauthErr == "" && r.Form.Get("approve") != "true" {
+		oauthErr = "access_denied"
+	}
+
+	if oauthErr == "" {
+		user := app.contextGetUser(r)
+
+		permissions, err := app.permissionsForRequest(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// The client gets the requested scopes the user actually holds.
+		scopes := req.scopes.Intersect(permissions)
+		if len(scopes) == 0 {
+			query.Set("error", "invalid_scope")
+			redirect.RawQuery = query.Encode()
+			http.Redirect(w, r, redirect.String(), http.StatusFound)
+			return
+		}
+
+		code, err := app.models.OAuth.NewCode(&data.OAuthCode{
+			ClientID:      req.client.ID,
+			UserID:        user.ID,
+			RedirectURI:   req.redirectURI,
+			Scopes:        scopes,
+			CodeChallenge: req.codeChallenge,
+			Expiry:        time.Now().Add(oauthCodeTTL),
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.audit(r, data.AuditOAuthConsent, user.ID, map[string]interface{}{"oauth_client_id": req.client.ID, "scopes": scopes})
+
+		query.Set("code", code)
+	} else {
+		query.Set("error", oauthErr)
+	}
+
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// createOAuthTokenHandler is the token endpoint (RFC 6749 section 3.2). It
+// supports the authorization_code grant with PKCE and, for confidential
+// clients, the client_credentials grant.
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	var userID int64
+	var scopes data.Permissions
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err := app.models.OAuth.UseCode(r.PostForm.Get("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// The redirect URI may only be left out if it was also left out of the
+		// authorization request, which requires the client to have just one.
+		redirectURI := r.PostForm.Get("redirect_uri")
+		if redirectURI == "" && len(client.RedirectURIs) == 1 {
+			redirectURI = client.RedirectURIs[0]
+		}
+
+		if code.ClientID != client.ID || code.RedirectURI != redirectURI {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			return
+		}
+
+		if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "code verifier does not match the code challenge")
+			return
+		}
+
+		userID = code.UserID
+		scopes = code.Scopes
+
+	case "client_credentials":
+		if !client.Confidential {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client credentials grant")
+			return
+		}
+
+		// The client acts as the user who registered it, so it can only get
+		// tokens while that user's account is activated, not deactivated and
+		// not scheduled for deletion.
+		owner, err := app.models.Users.Get(client.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if owner.Deactivated {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the account that registered the client has been deactivated")
+			return
+		}
+		if !owner.Activated {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the account that registered the client isn't activated")
+			return
+		}
+
+		scheduled, err := app.models.Users.IsDeletionScheduled(owner.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if scheduled {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the account that registered the client is scheduled for deletion")
+			return
+		}
+
+		userID = client.UserID
+		scopes = client.Scopes
+		if scope := r.PostForm.Get("scope"); scope != "" {
+			scopes = data.Permissions(strings.Fields(scope))
+			for _, code := range scopes {
+				if !slices.Contains(client.Scopes, code) {
+					app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "scope exceeds the scopes registered for the client")
+					return
+				}
+			}
+		}
+
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant type must be authorization_code or client_credentials")
+		return
+	}
+
+	token, err := app.models.OAuth.NewAccessToken(userID, client.ID, scopes, app.config.oauth.tokenTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(app.config.oauth.tokenTTL.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	}
+
+	app.writeOAuthResponse(w, r, http.StatusOK, env)
+}
+
+// introspectOAuthTokenHandler implements token introspection (RFC 7662). A
+// client can only introspect tokens issued to it; any other token is reported
+// as inactive.
+func (app *application) introspectOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	if !client.Confidential {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "introspection requires a confidential client")
+		return
+	}
+
+	user, grant, err := app.models.OAuth.GetForAccessToken(r.PostForm.Get("token"))
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if grant == nil || grant.ClientID != client.ID || !user.Activated {
+		app.writeOAuthResponse(w, r, http.StatusOK, envelope{"active": false})
+		return
+	}
+
+	env := envelope{
+		"active":     true,
+		"scope":      strings.Join(grant.Permissions, " "),
+		"client_id":  client.ClientID,
+		"username":   user.Email,
+		"sub":        user.ID,
+		"iat":        grant.IssuedAt.Unix(),
+		"exp":        grant.Expiry.Unix(),
+		"token_type": "Bearer",
+	}
+
+	app.writeOAuthResponse(w, r, http.StatusOK, env)
+}
+
+// revokeOAuthTokenHandler implements token revocation (RFC 7009). Unknown
+// tokens are not an error.
+func (app *application) revokeOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.OAuth.RevokeAccessToken(client.ID, r.PostForm.Get("token"))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateOAuthClient identifies the client making a request to one of the
+// /oauth endpoints, from HTTP Basic authentication or the client_id and
+// client_secret form parameters. Confidential clients must present their
+// secret.
+func (app *application) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body could not be parsed")
+		return nil, false
+	}
+
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := app.models.OAuth.GetClient(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidOAuthClientResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if client.Confidential {
+		hash := sha256.Sum256([]byte(secret))
+		if subtle.ConstantTimeCompare(hash[:], client.SecretHash) != 1 {
+			app.invalidOAuthClientResponse(w, r)
+			return nil, false
+		}
+	} else if secret != "" {
+		app.invalidOAuthClientResponse(w, r)
+		return nil, false
+	}
+
+	return client, true
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against the S256 challenge
+// sent with the authorization request (RFC 7636 section 4.6).
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// writeOAuthResponse writes a response from the token, introspection or
+// revocation endpoints. These are always JSON and must not be cached.
+func (app *application) writeOAuthResponse(w http.ResponseWriter, r *http.Request, status int, env envelope) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+
+	err := app.writeFormat(w, r, status, formatJSON, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oauthErrorResponse sends an error in the format of RFC 6749 section 5.2.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	app.writeOAuthResponse(w, r, status, envelope{"error": code, "error_description": description})
+}
+
+func (app *application) invalidOAuthClientResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+}
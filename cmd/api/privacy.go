@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// In privacy mode, endpoints that would otherwise reveal whether an email
+// address is registered answer every request with the same 202 response. The
+// real outcome is sent to the address by email instead.
+
+// writeAccepted sends a 202 response with the message. In privacy mode the
+// response is held back until the minimum response time has passed since
+// start, so that the work done for different outcomes can't be told apart by
+// timing.
+func (app *application) writeAccepted(w http.ResponseWriter, r *http.Request, start time.Time, message string) {
+	if app.config.privacy.enabled {
+		time.Sleep(time.Until(start.Add(app.config.privacy.minResponseTime)))
+	}
+
+	err := app.writeResponse(w, r, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// sendEmail sends an email in the background, logging any error.
+func (app *application) sendEmail(recipient, templateFile string, data map[string]interface{}) {
+	app.background(func() {
+		err := app.mailer.Send(recipient, templateFile, data)
+		if err != nil {
+			app.logger.PrintError(err.Error(), nil)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	formatJSON    = "application/json"
+	formatXML     = "application/xml"
+	formatMsgpack = "application/msgpack"
+	formatCSV     = "text/csv"
+)
+
+// supportedFormats lists the representations the API can produce, in order of
+// server preference. The order is used to break ties between media ranges that
+// carry the same quality value (including the "*/*" range).
+var supportedFormats = []string{formatJSON, formatXML, formatMsgpack, formatCSV}
+
+// mediaTypeAliases maps the media types clients commonly send onto the
+// canonical format names above.
+var mediaTypeAliases = map[string]string{
+	"application/json":        formatJSON,
+	"application/xml":         formatXML,
+	"text/xml":                formatXML,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+	"text/csv":                formatCSV,
+}
+
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept splits an Accept header into its media ranges. Ranges with an
+// invalid quality value are ignored.
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		if mediaType == "*" {
+			mediaType = "*/*"
+		}
+		if canonical, ok := mediaTypeAliases[mediaType]; ok {
+			mediaType = canonical
+		}
+
+		q := 1.0
+		valid := true
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				valid = false
+				break
+			}
+			q = parsed
+		}
+
+		if valid {
+			ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+		}
+	}
+
+	return ranges
+}
+
+// negotiateFormat picks the offer best matching the Accept header. For each
+// offer the most specific matching range decides its quality, so
+// "text/csv;q=0, */*" excludes CSV. An empty header accepts the first offer.
+func negotiateFormat(header string, offers []string) (string, bool) {
+	if len(offers) == 0 {
+		return "", false
+	}
+	if strings.TrimSpace(header) == "" {
+		return offers[0], true
+	}
+
+	ranges := parseAccept(header)
+
+	type candidate struct {
+		format string
+		q      float64
+		order  int
+	}
+	var candidates []candidate
+
+	for i, offer := range offers {
+		offerType, _, _ := strings.Cut(offer, "/")
+
+		specificity := -1
+		q := 0.0
+		for _, mr := range ranges {
+			s := -1
+			switch {
+			case mr.mediaType == offer:
+				s = 2
+			case mr.mediaType == offerType+"/*":
+				s = 1
+			case mr.mediaType == "*/*":
+				s = 0
+			}
+			if s > specificity {
+				specificity = s
+				q = mr.q
+			}
+		}
+
+		if specificity >= 0 && q > 0 {
+			candidates = append(candidates, candidate{format: offer, q: q, order: i})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].q != candidates[j].q {
+			return candidates[i].q > candidates[j].q
+		}
+		return candidates[i].order < candidates[j].order
+	})
+
+	return candidates[0].format, true
+}
+
+// responseOffers returns the formats that can represent the given envelope. CSV
+// is only offered for collection responses.
+func responseOffers(data envelope) []string {
+	if _, ok := collectionKey(data); ok {
+		return supportedFormats
+	}
+
+	offers := make([]string, 0, len(supportedFormats))
+	for _, format := range supportedFormats {
+		if format != formatCSV {
+			offers = append(offers, format)
+		}
+	}
+	return offers
+}
+
+// prettyJSON reports whether JSON output should be indented. It defaults to
+// true and can be switched off with the "pretty=false" query string parameter.
+func (app *application) prettyJSON(r *http.Request) bool {
+	pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	if err != nil {
+		return true
+	}
+	return pretty
+}
+
+// writeResponse encodes the envelope in the format negotiated from the
+// request's Accept header. If no supported format is acceptable a 406 Not
+// Acceptable response is sent instead.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	w.Header().Add("Vary", "Accept")
+
+	format, ok := negotiateFormat(r.Header.Get("Accept"), responseOffers(data))
+	if !ok {
+		app.notAcceptableResponse(w, r)
+		return nil
+	}
+
+	return app.writeFormat(w, r, status, format, data, headers)
+}
+
+func (app *application) writeFormat(w http.ResponseWriter, r *http.Request, status int, format string, data envelope, headers http.Header) error {
+	var body []byte
+	var err error
+
+	switch format {
+	case formatXML:
+		body, err = encodeXML(data)
+	case formatMsgpack:
+		body, err = encodeMsgpack(data)
+	case formatCSV:
+		body, err = encodeCSV(data)
+	default:
+		body, err = encodeJSON(data, app.prettyJSON(r))
+	}
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	contentType := format
+	if format != formatMsgpack {
+		contentType += "; charset=utf-8"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+
+	return nil
+}
+
+// acceptable rejects requests whose Accept header can't be satisfied by any
+// format the matched route can produce before the handler runs, so that no side
+// effects happen for a response the client is unable to read.
+func (app *application) acceptable(mux *chi.Mux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := negotiateFormat(r.Header.Get("Accept"), routeOffers(mux, r)); !ok {
+			w.Header().Add("Vary", "Accept")
+			app.notAcceptableResponse(w, r)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// routeOffers returns the formats the route matching the request can produce.
+// CSV is only offered by the routes listed in collectionRoutes.
+func routeOffers(mux *chi.Mux, r *http.Request) []string {
+	if r.Method == http.MethodGet {
+		rctx := chi.NewRouteContext()
+		if mux.Match(rctx, r.Method, r.URL.Path) && collectionRoutes[rctx.RoutePattern()] {
+			return supportedFormats
+		}
+	}
+
+	return responseOffers(nil)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	all := supportedFormats
+	noCSV := responseOffers(nil)
+
+	tests := []struct {
+		name   string
+		accept string
+		offers []string
+		want   string
+		wantOK bool
+	}{
+		{"empty header", "", all, formatJSON, true},
+		{"exact", "application/xml", all, formatXML, true},
+		{"alias", "text/xml", all, formatXML, true},
+		{"msgpack alias", "application/x-msgpack", all, formatMsgpack, true},
+		{"any", "*/*", all, formatJSON, true},
+		{"bare star", "*", all, formatJSON, true},
+		{"type wildcard", "text/*", all, formatCSV, true},
+		{"quality order", "application/json;q=0.5, application/xml", all, formatXML, true},
+		{"tie uses server order", "application/xml, application/json", all, formatJSON, true},
+		{"specific range wins", "text/csv;q=0, */*", []string{formatCSV}, "", false},
+		{"excluded json", "application/json;q=0, */*;q=0.1", all, formatXML, true},
+		{"invalid quality ignored", "application/xml;q=2, application/json", all, formatJSON, true},
+		{"csv not offered", "text/csv", noCSV, "", false},
+		{"unsupported", "image/png", all, "", false},
+		{"no offers", "*/*", nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := negotiateFormat(tt.accept, tt.offers)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("negotiateFormat(%q) = %q, %v; want %q, %v", tt.accept, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAcceptable(t *testing.T) {
+	app := &application{}
+
+	var called bool
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	mux := chi.NewRouter()
+	mux.Get("/v1/movies", handler)
+	mux.Post("/v1/movies", handler)
+	mux.Get("/v1/movies/{id}", handler)
+	mux.Get("/v1/movies/{id}/collaborators", handler)
+
+	tests := []struct {
+		method string
+		path   string
+		accept string
+		want   int
+	}{
+		{http.MethodGet, "/v1/movies", "text/csv", http.StatusNoContent},
+		{http.MethodGet, "/v1/movies/1/collaborators", "text/csv", http.StatusNoContent},
+		{http.MethodGet, "/v1/movies/1", "text/csv", http.StatusNotAcceptable},
+		{http.MethodPost, "/v1/movies", "text/csv", http.StatusNotAcceptable},
+		{http.MethodPost, "/v1/movies", "text/csv, application/json;q=0.5", http.StatusNoContent},
+		{http.MethodGet, "/v1/movies/1", "application/xml", http.StatusNoContent},
+		{http.MethodGet, "/v1/movies", "image/png", http.StatusNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path+" "+tt.accept, func(t *testing.T) {
+			called = false
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+
+			app.acceptable(mux).ServeHTTP(rr, r)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d; want %d", rr.Code, tt.want)
+			}
+			if called != (tt.want == http.StatusNoContent) {
+				t.Errorf("handler called = %v", called)
+			}
+		})
+	}
+}
@@ -7,6 +7,19 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
+// collectionRoutes are the GET routes that respond with a collection, which
+// can also be represented as CSV.
+var collectionRoutes = map[string]bool{
+	"/v1/movies":                    true,
+	"/v1/movies/{id}/collaborators": true,
+	"/v1/users/me/sessions":         true,
+	"/v1/users/me/api-keys":         true,
+	"/v1/oauth/clients":             true,
+	"/v1/admin/users":               true,
+	"/v1/admin/audit":               true,
+	"/v1/admin/roles":               true,
+}
+
 func (app *application) routes() http.Handler {
 	// initialize new router (mux)
 	mux := chi.NewRouter()
@@ -18,21 +31,80 @@ func (app *application) routes() http.Handler {
 	mux.Get("/v1/healthcheck", app.healthcheckHandler)
 
 	mux.Get("/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	mux.Post("/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	mux.Post("/v1/movies", app.requirePermission("movies:write:own", app.createMovieHandler))
 	mux.Get("/v1/movies/{id}", app.requirePermission("movies:read", app.showMovieHandler))
-	mux.Patch("/v1/movies/{id}", app.requirePermission("movies:write", app.updateMovieHandler))
-	mux.Delete("/v1/movies/{id}", app.requirePermission("movies:write", app.deleteMovieHandler))
+	mux.Patch("/v1/movies/{id}", app.requirePermission("movies:write:own", app.requireMovieWriteAccess(app.updateMovieHandler)))
+	mux.Delete("/v1/movies/{id}", app.requirePermission("movies:write:own", app.requireMovieWriteAccess(app.deleteMovieHandler)))
+
+	mux.Get("/v1/movies/{id}/collaborators", app.requirePermission("movies:write:own", app.requireMovieWriteAccess(app.listMovieCollaboratorsHandler)))
+	mux.Post("/v1/movies/{id}/collaborators", app.requirePermission("movies:write:own", app.requireMovieOwnership(app.addMovieCollaboratorHandler)))
+	mux.Delete("/v1/movies/{id}/collaborators/{userID}", app.requirePermission("movies:write:own", app.requireMovieOwnership(app.removeMovieCollaboratorHandler)))
 
 	mux.Post("/v1/users", app.registerUserHandler)
 	mux.Put("/v1/users/activated", app.activateUserHandler)
 	mux.Put("/v1/users/password", app.updateUserPasswordHandler)
+	mux.Put("/v1/users/unlocked", app.unlockUserHandler)
+	mux.Get("/v1/users/me", app.requireAccountCredentials(app.requireAuthenticatedUser(app.loadUser(app.showCurrentUserHandler))))
+	mux.Patch("/v1/users/me", app.requireAccountCredentials(app.requireAuthenticatedUser(app.loadUser(app.updateCurrentUserHandler))))
+	mux.Delete("/v1/users/me", app.requireAccountCredentials(app.requireAuthenticatedUser(app.loadUser(app.deleteCurrentUserHandler))))
+	mux.Get("/v1/users/me/export", app.requireAccountCredentials(app.requireAuthenticatedUser(app.loadUser(app.exportCurrentUserHandler))))
+	mux.Get("/v1/users/me/sessions", app.requireAccountCredentials(app.requireAuthenticatedUser(app.loadUser(app.listCurrentUserSessionsHandler))))
+	mux.Delete("/v1/users/me/sessions/{id}", app.requireAccountCredentials(app.requireAuthenticatedUser(app.loadUser(app.deleteCurrentUserSessionHandler))))
+	mux.Get("/v1/users/me/api-keys", app.requireAccountCredentials(app.requireActivatedUser(app.listAPIKeysHandler)))
+	mux.Post("/v1/users/me/api-keys", app.requireAccountCredentials(app.requireActivatedUser(app.createAPIKeyHandler)))
+	mux.Delete("/v1/users/me/api-keys/{id}", app.requireAccountCredentials(app.requireActivatedUser(app.deleteAPIKeyHandler)))
+	mux.Post("/v1/users/me/totp", app.requireAccountCredentials(app.requireActivatedUser(app.loadUser(app.enableTOTPHandler))))
+	mux.Put("/v1/users/me/totp/confirmed", app.requireAccountCredentials(app.requireActivatedUser(app.loadUser(app.confirmTOTPHandler))))
+	mux.Delete("/v1/users/me/totp", app.requireAccountCredentials(app.requireActivatedUser(app.loadUser(app.disableTOTPHandler))))
+	mux.Post("/v1/users/me/totp/recovery-codes", app.requireAccountCredentials(app.requireActivatedUser(app.loadUser(app.createRecoveryCodesHandler))))
+	mux.Post("/v1/users/me/email", app.requireAccountCredentials(app.requireActivatedUser(app.loadUser(app.requestEmailChangeHandler))))
+	mux.Put("/v1/users/email", app.updateUserEmailHandler)
 
 	mux.Post("/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	mux.Post("/v1/tokens/authentication/totp", app.createTOTPAuthenticationTokenHandler)
+	mux.Post("/v1/tokens/authentication/magic-link", app.createMagicLinkAuthenticationTokenHandler)
+	mux.Post("/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	mux.Delete("/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	if app.signer != nil {
+		mux.Post("/v1/tokens/stateless", app.requireAccountCredentials(app.requireAuthenticatedUser(app.createStatelessTokenHandler)))
+	}
+	mux.Post("/v1/tokens/refresh", app.createRefreshTokenHandler)
 	mux.Post("/v1/tokens/activation", app.createActivationTokenHandler)
 	mux.Post("/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
+	mux.Get("/v1/oauth/clients", app.requireAccountCredentials(app.requireActivatedUser(app.listOAuthClientsHandler)))
+	mux.Post("/v1/oauth/clients", app.requireAccountCredentials(app.requireActivatedUser(app.createOAuthClientHandler)))
+	mux.Delete("/v1/oauth/clients/{id}", app.requireAccountCredentials(app.requireActivatedUser(app.deleteOAuthClientHandler)))
+
+	mux.Get("/oauth/authorize", app.requireAccountCredentials(app.requireActivatedUser(app.showAuthorizationHandler)))
+	mux.Post("/oauth/authorize", app.requireAccountCredentials(app.requireActivatedUser(app.authorizeHandler)))
+	mux.Post("/oauth/token", app.createOAuthTokenHandler)
+	mux.Post("/oauth/introspect", app.introspectOAuthTokenHandler)
+	mux.Post("/oauth/revoke", app.revokeOAuthTokenHandler)
+
+	mux.Get("/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	mux.Get("/v1/admin/users/{id}", app.requirePermission("users:admin", app.showUserHandler))
+	mux.Post("/v1/admin/users/{id}/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	mux.Delete("/v1/admin/users/{id}/permissions/{code}", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+	mux.Put("/v1/admin/users/{id}/deactivated", app.requirePermission("users:admin", app.deactivateUserHandler))
+	mux.Delete("/v1/admin/users/{id}/deactivated", app.requirePermission("users:admin", app.reactivateUserHandler))
+	mux.Delete("/v1/admin/users/{id}/tokens", app.requirePermission("users:admin", app.logoutUserHandler))
+	mux.Delete("/v1/admin/users/{id}/lockout", app.requirePermission("users:admin", app.unlockUserLoginHandler))
+
+	mux.Post("/v1/admin/users/{id}/roles", app.requirePermission("users:admin", app.assignUserRolesHandler))
+	mux.Delete("/v1/admin/users/{id}/roles/{name}", app.requirePermission("users:admin", app.removeUserRoleHandler))
+
+	mux.Get("/v1/admin/audit", app.requirePermission("users:admin", app.listAuditEventsHandler))
+
+	mux.Get("/v1/admin/roles", app.requirePermission("users:admin", app.listRolesHandler))
+	mux.Post("/v1/admin/roles", app.requirePermission("users:admin", app.createRoleHandler))
+	mux.Get("/v1/admin/roles/{id}", app.requirePermission("users:admin", app.showRoleHandler))
+	mux.Delete("/v1/admin/roles/{id}", app.requirePermission("users:admin", app.deleteRoleHandler))
+	mux.Post("/v1/admin/roles/{id}/permissions", app.requirePermission("users:admin", app.addRolePermissionsHandler))
+	mux.Delete("/v1/admin/roles/{id}/permissions/{code}", app.requirePermission("users:admin", app.removeRolePermissionHandler))
+
 	// mux.Get("/debug/vars", expvar.Handler().ServeHTTP)
 	mux.Get("/debug/vars", app.requirePermission("metrics:view", expvar.Handler().ServeHTTP))
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(mux)))))
+	return app.metrics(app.compress(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(app.acceptable(mux)))))))
 }
@@ -28,6 +28,23 @@ func (app *application) serve() error {
 
 	shutDownError := make(chan error)
 
+	jobs, err := app.jobs()
+	if err != nil {
+		return err
+	}
+
+	// stop is closed on shutdown to end the background jobs and the listener.
+	stop := make(chan struct{})
+
+	if app.config.cache.enabled || app.config.authCache.enabled || app.signer != nil {
+		err = app.listenForInvalidations(stop)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.startJobs(jobs, stop)
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -49,6 +66,7 @@ func (app *application) serve() error {
 			"addr": srv.Addr,
 		})
 
+		close(stop)
 		app.wg.Wait()
 		shutDownError <- nil
 
@@ -61,7 +79,7 @@ func (app *application) serve() error {
 	}
 	app.logger.PrintInfo("starting server", properties)
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
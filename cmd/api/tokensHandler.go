@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/kcharymyrat/greenlight/internal/data"
+	"github.com/kcharymyrat/greenlight/internal/jwt"
 	"github.com/kcharymyrat/greenlight/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,10 +34,26 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	attempt, ok := app.checkLoginAllowed(w, r, input.Email)
+	if !ok {
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			// Take as long as a real password check would, so the response
+			// time doesn't give away that the address isn't registered.
+			data.SimulatePasswordCheck(input.Password)
+
+			app.audit(r, data.AuditLoginFailed, 0, map[string]interface{}{"email_hash": app.auditEmailHash(input.Email), "reason": "unknown email"})
+
+			err = app.recordLoginFailure(r, input.Email, attempt, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -46,24 +67,495 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 	if !match {
+		app.audit(r, data.AuditLoginFailed, user.ID, map[string]interface{}{"reason": "wrong password"})
+
+		err = app.recordLoginFailure(r, input.Email, attempt, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	err = app.models.LoginAttempts.DeleteForEmail(input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Now that the password is known, replace a hash made with an outdated
+	// algorithm or cost.
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Users.UpdatePasswordHash(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.login(w, r, user)
+}
+
+// unlockUserHandler lifts a login lockout using the token emailed to the user
+// when their account was locked.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeUnlock, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unlock token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.LoginAttempts.DeleteForEmail(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeUnlock, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditUnlock, user.ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "your account was successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// login is called once a user has proved their identity with a first factor.
+// Users with two-factor authentication enabled are sent a short-lived
+// challenge token to exchange, together with a TOTP code, at
+// createTOTPAuthenticationTokenHandler. Everyone else is logged in straight
+// away.
+func (app *application) login(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.Deactivated {
+		app.audit(r, data.AuditLoginFailed, user.ID, map[string]interface{}{"reason": "account deactivated"})
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	enabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !enabled {
+		app.completeLogin(w, r, user)
+		return
+	}
+
+	challenge, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTOTPChallenge)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"totp_required": true, "challenge_token": challenge}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// completeLogin issues authentication and refresh tokens to a fully
+// authenticated user.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	// Logging in during the grace period cancels a pending account deletion.
+	_, err := app.models.Users.CancelDeletion(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env, err := app.issueAuthenticationTokens(r, user.ID, 0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditLogin, user.ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTOTPAuthenticationTokenHandler completes a login for a user with
+// two-factor authentication enabled. A challenge token can only be tried once:
+// a wrong code means logging in with the password again.
+func (app *application) createTOTPAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.ChallengeToken)
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTOTPChallenge, input.ChallengeToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("challenge_token", "invalid or expired challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeTOTPChallenge, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	// The account may have been deactivated since the challenge was issued.
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.Code)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
+	if !ok {
+		app.audit(r, data.AuditLoginFailed, user.ID, map[string]interface{}{"reason": "invalid second factor"})
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// createRefreshTokenHandler exchanges a refresh token for a new access token and
+// a new refresh token. The old refresh token can't be used again.
+func (app *application) createRefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.UseRefreshToken(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env, err := app.issueAuthenticationTokens(r, token.UserID, token.FamilyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// issueAuthenticationTokens creates an access token and a refresh token for the
+// user. A familyID of zero starts a new login; otherwise the tokens replace
+// those previously issued in that family.
+func (app *application) issueAuthenticationTokens(r *http.Request, userID, familyID int64) (envelope, error) {
+	var err error
+
+	if familyID == 0 {
+		familyID, err = app.models.Tokens.NewFamily()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ip := realip.FromRequest(r)
+	userAgent := truncate(r.UserAgent(), 256)
+
+	token, err := app.models.Tokens.NewSession(userID, app.config.tokens.accessTTL, data.ScopeAuthentication, familyID, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := app.models.Tokens.NewSession(userID, app.config.tokens.refreshTTL, data.ScopeRefresh, familyID, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{"authentication_token": token, "refresh_token": refreshToken}, nil
+}
+
+// createStatelessTokenHandler exchanges the opaque authentication token the
+// request was made with for a signed token, which can be verified without a
+// database lookup. The user's current permissions are embedded in it.
+func (app *application) createStatelessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Don't let a stateless token be renewed with itself, which would keep
+	// the embedded permissions alive indefinitely.
+	if app.contextGetClaims(r) != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.jwt.ttl)
+
+	claims := jwt.Claims{
+		ID:          hex.EncodeToString(randomBytes),
+		Subject:     user.ID,
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   expiry.Unix(),
+		Name:        user.Name,
+		Email:       user.Email,
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+
+	token, err := app.signer.Sign(claims)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"stateless_token": map[string]interface{}{
+		"token":  token,
+		"expiry": time.Unix(claims.ExpiresAt, 0),
+	}}
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeStatelessTokens denylists every stateless token issued to the users so
+// far. It is used wherever all of a user's sessions are ended, and wherever
+// permissions are taken away, since the tokens carry the permissions they were
+// issued with.
+func (app *application) revokeStatelessTokens(userIDs ...int64) error {
+	if app.signer == nil {
+		return nil
+	}
+
+	for _, userID := range userIDs {
+		err := app.models.Revocations.RevokeUser(userID, time.Now().Add(app.config.jwt.ttl))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteAuthenticationTokenHandler logs out by revoking the token the request
+// was authenticated with.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	// Stateless tokens can't be deleted, so they are denylisted until they
+	// expire instead.
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.models.Revocations.RevokeToken(claims.ID, claims.Subject, time.Unix(claims.ExpiresAt, 0))
+	} else {
+		err = app.models.Tokens.Delete(app.contextGetToken(r))
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditLogout, app.contextGetUser(r).ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createMagicLinkTokenHandler emails a single-use login token to the address,
+// for users who'd rather not use a password. The response is the same whether
+// or not the address belongs to an account.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.magicLinks.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 15*time.Minute, data.ScopeMagicLink)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]interface{}{
+				"magicLinkToken": token.Plaintext,
+			}
+
+			err := app.mailer.Send(user.Email, "token_magic_link.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err.Error(), nil)
+			}
+		})
+	}
+
+	app.writeAccepted(w, r, start, "if an activated account exists for this address, an email will be sent to it containing a login link")
+}
+
+// createMagicLinkAuthenticationTokenHandler exchanges a login token sent by
+// email for an authentication token, or for a TOTP challenge if the user has
+// two-factor authentication enabled.
+func (app *application) createMagicLinkAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMagicLink, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMagicLink, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.login(w, r, user)
 }
 
 // Generate a password reset token and send it to the user's email address.
 func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 
 	var input struct {
 		Email string `json:"email"`
@@ -82,9 +574,16 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		return
 	}
 
+	message := "an email will be sent to you containing password reset instructions"
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && app.config.privacy.enabled:
+			app.sendEmail(input.Email, "account_not_found.tmpl", map[string]interface{}{
+				"action": "reset the password of an account",
+			})
+			app.writeAccepted(w, r, start, message)
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddError("email", "no matching email address found")
 			app.failedValidationResponse(w, r, v.Errors)
@@ -95,6 +594,12 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	}
 
 	if !user.Activated {
+		if app.config.privacy.enabled {
+			app.sendEmail(user.Email, "user_not_activated.tmpl", nil)
+			app.writeAccepted(w, r, start, message)
+			return
+		}
+
 		v.AddError("email", "user account must be activated")
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -122,11 +627,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	})
 
 	// Send a 202 Accepted response and confirmation message to the client.
-	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	app.writeAccepted(w, r, start, message)
 }
 
 // Verify the password reset token and set a new password for the user.
@@ -167,6 +668,11 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	if data.ValidateNewPassword(v, input.Password, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Set the new password for the user.
 	err = user.Password.Set(input.Password)
 	if err != nil {
@@ -193,16 +699,40 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// Whoever knew the old password is logged out everywhere.
+	err = app.models.Tokens.DeleteSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeStatelessTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// A new password makes the failed attempts against the old one moot.
+	err = app.models.LoginAttempts.DeleteForEmail(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPasswordReset, user.ID, nil)
+
 	// Send the user a confirmation message.
 	env := envelope{"message": "your password was successfully reset"}
 
-	err = app.writeJSON(w, http.StatusOK, env, nil)
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
 	var input struct {
 		Email string `json:"email"`
 	}
@@ -220,9 +750,16 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	message := "an email will be sent to you containing activation instructions"
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && app.config.privacy.enabled:
+			app.sendEmail(input.Email, "account_not_found.tmpl", map[string]interface{}{
+				"action": "activate an account",
+			})
+			app.writeAccepted(w, r, start, message)
 		case errors.Is(err, data.ErrRecordNotFound):
 			v.AddError("email", "no matching email address found")
 			app.failedValidationResponse(w, r, v.Errors)
@@ -233,11 +770,29 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 	}
 
 	if user.Activated {
+		if app.config.privacy.enabled {
+			app.sendEmail(user.Email, "user_already_activated.tmpl", nil)
+			app.writeAccepted(w, r, start, message)
+			return
+		}
+
 		v.AddError("email", "user has already been activated")
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Only an admin can undo a deactivation. In privacy mode nothing is sent,
+	// so that the response doesn't reveal the account's state.
+	if user.Deactivated {
+		if app.config.privacy.enabled {
+			app.writeAccepted(w, r, start, message)
+			return
+		}
+
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
 	// Otherwise, create a new activation token.
 	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
@@ -247,7 +802,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 
 	app.background(func() {
 		data := map[string]interface{}{
-			"passwordResetToken": token.Plaintext,
+			"activationToken": token.Plaintext,
 		}
 		// Since email addresses MAY be case sensitive, notice that we are sending this
 		// email using the address stored in our database for the user --- not to the
@@ -258,11 +813,5 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		}
 	})
 
-	env := envelope{"message": "an email will be sent to you containing activation instructions"}
-
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
-
+	app.writeAccepted(w, r, start, message)
 }
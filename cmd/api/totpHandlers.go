@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/data"
+	"github.com/kcharymyrat/greenlight/internal/totp"
+	"github.com/kcharymyrat/greenlight/internal/validator"
+)
+
+// totpIssuer is the account issuer shown in authenticator apps.
+const totpIssuer = "Greenlight"
+
+// enableTOTPHandler starts two-factor enrollment by generating a secret for the
+// user to add to their authenticator app. It has no effect on logging in until
+// confirmed with confirmTOTPHandler.
+func (app *application) enableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if !app.checkPassword(w, r, user, input.Password) {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"totp": map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}}
+
+	err = app.writeResponse(w, r, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTOTPHandler enables two-factor authentication once the user has sent
+// a valid code for the enrolled secret, and returns their recovery codes.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	enrollment, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if enrollment.Confirmed {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	counter, ok := totp.Validate(input.Code, enrollment.Secret, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TOTP.Confirm(user.ID, counter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTOTPEnabled, user.ID, nil)
+
+	env := envelope{
+		"message":        "two-factor authentication is now enabled, store the recovery codes somewhere safe",
+		"recovery_codes": codes,
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTOTPHandler turns two-factor authentication off. Both the password and
+// a current code (or recovery code) are required.
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if !app.checkPassword(w, r, user, input.Password) {
+		return
+	}
+
+	if !app.checkSecondFactor(w, r, user.ID, input.Code) {
+		return
+	}
+
+	err = app.models.TOTP.Disable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditTOTPDisabled, user.ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "two-factor authentication is now disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRecoveryCodesHandler replaces the user's recovery codes, for example
+// after most of them have been used.
+func (app *application) createRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if !app.checkSecondFactor(w, r, user.ID, input.Code) {
+		return
+	}
+
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifySecondFactor checks a TOTP code or, failing that, a recovery code for
+// the user. Each code is accepted only once.
+func (app *application) verifySecondFactor(userID int64, code string) (bool, error) {
+	enrollment, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	if !enrollment.Confirmed {
+		return false, nil
+	}
+
+	if counter, ok := totp.Validate(code, enrollment.Secret, time.Now(), 1); ok {
+		return app.models.TOTP.UseCounter(userID, counter)
+	}
+
+	return app.models.TOTP.UseRecoveryCode(userID, code)
+}
+
+// checkSecondFactor validates a code with verifySecondFactor, sending an error
+// response and returning false if it isn't accepted.
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, userID int64, code string) bool {
+	v := validator.New()
+
+	if v.Check(code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	ok, err := app.verifySecondFactor(userID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+// checkPassword confirms the user's current password, sending an error
+// response and returning false if it doesn't match.
+func (app *application) checkPassword(w http.ResponseWriter, r *http.Request, user *data.User, password string) bool {
+	v := validator.New()
+
+	if v.Check(password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+
+	return true
+}
@@ -4,13 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/kcharymyrat/greenlight/internal/data"
 	"github.com/kcharymyrat/greenlight/internal/validator"
 )
 
+const registrationAcceptedMessage = "an email will be sent to the address containing activation instructions"
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
 	var input struct {
 		Name     string `json:"name"`
 		Email    string `json:"email"`
@@ -41,9 +46,24 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	// The new user is given the configured default role.
+	var roles []string
+	if app.config.roles.defaultRole != "" {
+		roles = append(roles, app.config.roles.defaultRole)
+	}
+
+	err = app.models.Users.Insert(user, roles...)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicateEmail) && app.config.privacy.enabled:
+			existing, err := app.models.Users.GetByEmail(user.Email)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.sendEmail(existing.Email, "user_registration_attempt.tmpl", nil)
+			app.writeAccepted(w, r, start, registrationAcceptedMessage)
 		case errors.Is(err, data.ErrDuplicateEmail):
 			v.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, v.Errors)
@@ -53,12 +73,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	app.audit(r, data.AuditUserRegistered, user.ID, nil)
 
 	// Generate activation token to be send
 	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
@@ -79,7 +94,14 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 	})
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	// The new user isn't shown in privacy mode, as there's no user to show when
+	// the address was already taken.
+	if app.config.privacy.enabled {
+		app.writeAccepted(w, r, start, registrationAcceptedMessage)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -115,6 +137,13 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// A token issued before an admin deactivated the account can't be used to
+	// undo the deactivation.
+	if user.Deactivated {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+
 	user.Activated = true
 
 	err = app.models.Users.Update(user)
@@ -134,9 +163,479 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.audit(r, data.AuditUserActivated, user.ID, nil)
+
 	fmt.Println("user =", user, "err =", err)
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword *string `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	// Changing the password requires the current one, so that a stolen
+	// authentication token can't be used to take over the account.
+	if input.Password != nil {
+		if input.CurrentPassword == nil {
+			v.AddError("current_password", "must be provided to change the password")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		match, err := user.Password.Matches(*input.CurrentPassword)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !match {
+			v.AddError("current_password", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Any outstanding password reset tokens are no longer needed once the
+	// password has been changed, and every other session is logged out in case
+	// the old password was compromised. Stateless tokens can't be told apart, so
+	// all of them are revoked, including one this request was made with. API
+	// keys are left alone; they are managed separately.
+	if input.Password != nil {
+		err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Tokens.DeleteOtherSessionsForUser(user.ID, app.contextGetToken(r))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.revokeStatelessTokens(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.audit(r, data.AuditPasswordChanged, user.ID, nil)
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Start changing the user's email address. A token is sent to the new address
+// and a notice to the current one; the address only changes once the token is
+// redeemed.
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from the current email address")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// Whether the address is already taken isn't checked here, as that would
+	// reveal which addresses have accounts. A taken address is rejected when
+	// the change is confirmed, which needs access to that mailbox.
+
+	// Only the most recently requested address can be confirmed.
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.NewEmailChange(user.ID, 24*time.Hour, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(input.Email, "token_email_change.tmpl", map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.PrintError(err.Error(), nil)
+		}
+
+		err = app.mailer.Send(user.Email, "user_email_change_notice.tmpl", map[string]interface{}{
+			"newEmail": input.Email,
+		})
+		if err != nil {
+			app.logger.PrintError(err.Error(), nil)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Redeem an email-change token and swap the user's email address.
+func (app *application) updateUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, newEmail, err := app.models.Users.GetForEmailChangeToken(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Email = newEmail
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Password reset tokens were sent to the old address, so they are revoked
+	// along with the email change tokens.
+	for _, scope := range []string{data.ScopeEmailChange, data.ScopePasswordReset} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.audit(r, data.AuditEmailChanged, user.ID, nil)
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Return an archive of all personal data held about the user.
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tokens, err := app.models.Tokens.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies, err := app.models.Movies.GetAllCreatedBy(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	collaborations, err := app.models.Movies.GetAllCollaboratingOn(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	oauthClients, err := app.models.OAuth.GetClientsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The TOTP secret and recovery codes themselves are credentials, so only
+	// the state of the enrollment is exported.
+	totp := map[string]interface{}{"enrolled": false, "enabled": false, "recovery_codes_remaining": 0}
+
+	enrollment, err := app.models.TOTP.Get(user.ID)
+	switch {
+	case err == nil:
+		remaining, err := app.models.TOTP.RecoveryCodesRemaining(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		totp["enrolled"] = true
+		totp["enabled"] = enrollment.Confirmed
+		totp["recovery_codes_remaining"] = remaining
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"exported_at":    time.Now().UTC(),
+		"user":           user,
+		"permissions":    permissions,
+		"roles":          roles,
+		"tokens":         tokens,
+		"api_keys":       apiKeys,
+		"movies":         movies,
+		"collaborations": collaborations,
+		"oauth_clients":  oauthClients,
+		"totp":           totp,
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-export-%d.json"`, user.ID))
+	headers.Set("Cache-Control", "no-store")
+
+	err = app.writeResponse(w, r, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Schedule the user's account for deletion once the grace period has passed.
+// Logging in again before then cancels the deletion.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	deletionAt := time.Now().Add(app.config.accountDeletion.gracePeriod)
+
+	err = app.models.Users.ScheduleDeletion(user.ID, deletionAt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Log the user out everywhere.
+	err = app.models.Tokens.DeleteAllScopesForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeStatelessTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"deletionAt": deletionAt.UTC().Format(time.RFC1123),
+		}
+
+		err := app.mailer.Send(user.Email, "user_deletion_scheduled.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err.Error(), nil)
+		}
+	})
+
+	env := envelope{
+		"message":     "your account is scheduled for deletion, log in again before then to cancel",
+		"deletion_at": deletionAt.UTC(),
+	}
+
+	err = app.writeResponse(w, r, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listCurrentUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCurrentUserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteSession(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditSessionsRevoked, user.ID, map[string]interface{}{"session_id": id})
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -7,13 +7,16 @@ require (
 	github.com/go-chi/chi/v5 v5.0.12
 	github.com/go-mail/mail/v2 v2.3.0
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.17.11
 	github.com/lib/pq v1.10.9
 	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce
 	golang.org/x/crypto v0.22.0
+	golang.org/x/sync v0.7.0
 	golang.org/x/time v0.5.0
 )
 
 require (
+	golang.org/x/sys v0.19.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/mail.v2 v2.3.1 // indirect
 )
@@ -0,0 +1,169 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Audit event types.
+const (
+	AuditUserRegistered        = "user_registered"
+	AuditUserActivated         = "user_activated"
+	AuditUserDeactivated       = "user_deactivated"
+	AuditUserReactivated       = "user_reactivated"
+	AuditUserDeleted           = "user_deleted"
+	AuditLogin                 = "login"
+	AuditLoginFailed           = "login_failed"
+	AuditLogout                = "logout"
+	AuditLockout               = "lockout"
+	AuditUnlock                = "unlock"
+	AuditRefreshTokenReused    = "refresh_token_reused"
+	AuditSessionsRevoked       = "sessions_revoked"
+	AuditPasswordReset         = "password_reset"
+	AuditPasswordChanged       = "password_changed"
+	AuditEmailChanged          = "email_changed"
+	AuditTOTPEnabled           = "totp_enabled"
+	AuditTOTPDisabled          = "totp_disabled"
+	AuditAPIKeyCreated         = "api_key_created"
+	AuditAPIKeyDeleted         = "api_key_deleted"
+	AuditPermissionsGranted    = "permissions_granted"
+	AuditPermissionRevoked     = "permission_revoked"
+	AuditRolesAssigned         = "roles_assigned"
+	AuditRoleRemoved           = "role_removed"
+	AuditRoleCreated           = "role_created"
+	AuditRoleDeleted           = "role_deleted"
+	AuditRolePermissionsAdded  = "role_permissions_added"
+	AuditRolePermissionRemoved = "role_permission_removed"
+	AuditOAuthClientCreated    = "oauth_client_created"
+	AuditOAuthClientDeleted    = "oauth_client_deleted"
+	AuditOAuthConsent          = "oauth_consent"
+)
+
+// AuditEvent records something security relevant that happened. The actor is
+// the user who did it, if anyone was logged in, and the subject the user it was
+// done to.
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	CreatedAt time.Time              `json:"created_at"`
+	Type      string                 `json:"type"`
+	ActorID   *int64                 `json:"actor_id"`
+	SubjectID *int64                 `json:"subject_id"`
+	IP        string                 `json:"ip"`
+	UserAgent string                 `json:"user_agent"`
+	Details   map[string]interface{} `json:"details"`
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+func (m AuditModel) Insert(event *AuditEvent) error {
+	details := event.Details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO audit_events (type, actor_id, subject_id, ip, user_agent, details)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	args := []interface{}{event.Type, event.ActorID, event.SubjectID, event.IP, event.UserAgent, detailsJSON}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// Purge deletes the events created before cutoff and strips the IP address,
+// user agent and email addresses from the events of users that no longer
+// exist. It returns the number of events affected. This goes through the
+// purge_audit_events database function, as the table otherwise rejects
+// changes.
+func (m AuditModel) Purge(cutoff time.Time) (int64, error) {
+	query := `SELECT purge_audit_events($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var count int64
+
+	err := m.DB.QueryRowContext(ctx, query, cutoff).Scan(&count)
+	return count, err
+}
+
+// GetAll returns the events matching the filters. Empty types, nil times and
+// zero IDs don't filter.
+func (m AuditModel) GetAll(types []string, from, to *time.Time, actorID, subjectID int64, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, type, actor_id, subject_id, ip, user_agent, details
+	FROM audit_events
+	WHERE (type = ANY($1) OR cardinality($1::text[]) = 0)
+	AND ($2::timestamptz IS NULL OR created_at >= $2)
+	AND ($3::timestamptz IS NULL OR created_at < $3)
+	AND (actor_id = $4 OR $4 = 0)
+	AND (subject_id = $5 OR $5 = 0)
+	ORDER BY %s %s
+	LIMIT $6 OFFSET $7`, filters.sortColumn(), filters.sortDirection())
+
+	if types == nil {
+		types = []string{}
+	}
+
+	args := []interface{}{pq.Array(types), from, to, actorID, subjectID, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var event AuditEvent
+		var details []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.Type,
+			&event.ActorID,
+			&event.SubjectID,
+			&event.IP,
+			&event.UserAgent,
+			&details,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(details, &event.Details)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/cache"
+)
+
+// AuthInvalidationChannel is the PostgreSQL NOTIFY channel on which triggers on
+// the users, tokens and users_permissions tables publish the ID of the affected
+// user. A payload of "*" invalidates every user.
+const AuthInvalidationChannel = "auth_invalidations"
+
+type cachedTokenUser struct {
+	user   User
+	expiry time.Time
+}
+
+// AuthCache holds short-lived copies of authentication token lookups and user
+// permissions, which are otherwise queried on every protected request.
+type AuthCache struct {
+	tokens      *cache.Cache[string, cachedTokenUser]
+	permissions *cache.Cache[int64, Permissions]
+}
+
+func NewAuthCache(capacity int, ttl time.Duration) *AuthCache {
+	return &AuthCache{
+		tokens:      cache.New[string, cachedTokenUser](capacity, ttl),
+		permissions: cache.New[int64, Permissions](capacity, ttl),
+	}
+}
+
+// InvalidateUser drops every cached token lookup and the permissions for the
+// user.
+func (c *AuthCache) InvalidateUser(userID int64) {
+	c.tokens.RemoveFunc(func(_ string, v cachedTokenUser) bool {
+		return v.user.ID == userID
+	})
+	c.permissions.Remove(userID)
+}
+
+func (c *AuthCache) InvalidateToken(tokenHash []byte) {
+	c.tokens.Remove(string(tokenHash))
+}
+
+func (c *AuthCache) PurgePermissions() {
+	c.permissions.Purge()
+}
+
+func (c *AuthCache) Purge() {
+	c.tokens.Purge()
+	c.permissions.Purge()
+}
+
+func (c *AuthCache) Stats() map[string]cache.Stats {
+	return map[string]cache.Stats{
+		"tokens":      c.tokens.Stats(),
+		"permissions": c.permissions.Stats(),
+	}
+}
+
+func (c *AuthCache) getUser(tokenHash []byte, load func() (*User, time.Time, error)) (*User, error) {
+	key := string(tokenHash)
+
+	if v, ok := c.tokens.Get(key); ok && time.Now().Before(v.expiry) {
+		return v.user.clone(), nil
+	}
+
+	generation := c.tokens.Generation()
+
+	user, expiry, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.tokens.SetIfGeneration(key, cachedTokenUser{user: *user, expiry: expiry}, generation)
+
+	return user.clone(), nil
+}
+
+func (c *AuthCache) getPermissions(userID int64, load func() (Permissions, error)) (Permissions, error) {
+	if permissions, ok := c.permissions.Get(userID); ok {
+		return append(Permissions{}, permissions...), nil
+	}
+
+	generation := c.permissions.Generation()
+
+	permissions, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.permissions.SetIfGeneration(userID, permissions, generation)
+
+	return append(Permissions{}, permissions...), nil
+}
@@ -0,0 +1,180 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Collaborator is a user who has been granted write access to a movie they
+// don't own.
+type Collaborator struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// MovieAccess describes a user's relationship to a movie.
+type MovieAccess struct {
+	Owner        bool
+	Collaborator bool
+}
+
+func (m MovieModel) GetAccess(movieID, userID int64) (MovieAccess, error) {
+	if movieID < 1 {
+		return MovieAccess{}, ErrRecordNotFound
+	}
+
+	query := `SELECT COALESCE(movies.created_by = $2, false),
+	EXISTS (SELECT 1 FROM movie_collaborators WHERE movie_id = movies.id AND user_id = $2)
+	FROM movies
+	WHERE movies.id = $1`
+
+	var access MovieAccess
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, userID).Scan(&access.Owner, &access.Collaborator)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return MovieAccess{}, ErrRecordNotFound
+		default:
+			return MovieAccess{}, err
+		}
+	}
+
+	return access, nil
+}
+
+func (m MovieModel) GetCollaborators(movieID int64) ([]*Collaborator, error) {
+	query := `SELECT users.id, users.name
+	FROM movie_collaborators
+	INNER JOIN users ON users.id = movie_collaborators.user_id
+	WHERE movie_collaborators.movie_id = $1
+	ORDER BY users.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collaborators := []*Collaborator{}
+
+	for rows.Next() {
+		var collaborator Collaborator
+		err := rows.Scan(&collaborator.UserID, &collaborator.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		collaborators = append(collaborators, &collaborator)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return collaborators, nil
+}
+
+// AddCollaborator grants the user write access to the movie. It returns
+// ErrRecordNotFound if the user doesn't exist.
+func (m MovieModel) AddCollaborator(movieID, userID int64) error {
+	query := `INSERT INTO movie_collaborators (movie_id, user_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, movieID, userID)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "violates foreign key constraint"):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m MovieModel) RemoveCollaborator(movieID, userID int64) error {
+	query := `DELETE FROM movie_collaborators
+	WHERE movie_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, movieID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected < 1 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAllCollaboratingOn returns every movie the user has been made a
+// collaborator on.
+func (m MovieModel) GetAllCollaboratingOn(userID int64) ([]*Movie, error) {
+	query := `SELECT movies.id, movies.created_at, movies.updated_at, COALESCE(movies.created_by, 0), movies.title,
+		movies.year, movies.runtime, movies.genres, movies.version
+	FROM movies
+	INNER JOIN movie_collaborators ON movie_collaborators.movie_id = movies.id
+	WHERE movie_collaborators.user_id = $1
+	ORDER BY movies.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.CreatedBy,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
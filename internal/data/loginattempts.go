@@ -0,0 +1,146 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// LoginAttemptStats summarises recent failed logins for an email address and
+// for the client IP address trying it.
+type LoginAttemptStats struct {
+	EmailFailures int
+	LastFailure   time.Time
+	IPFailures    int
+}
+
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// Reserve records a login attempt for the email address before the password
+// is checked, so that concurrent attempts can't all get past the limits. While
+// holding a lock on the address, allow decides from the stats of the failed
+// logins since the given time whether the attempt may go ahead. If it returns
+// false nothing is recorded and the returned ID is zero. A reserved attempt
+// counts as a failure until DeleteForEmail is called after a successful login.
+func (m LoginAttemptModel) Reserve(email, ip string, since time.Time, allow func(*LoginAttemptStats) bool) (int64, *LoginAttemptStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	// The lock is released when the transaction ends, so it is only held for
+	// as long as it takes to count and insert.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext(lower($1)))`, email)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stats, err := loginAttemptStats(ctx, tx, email, ip, since)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !allow(stats) {
+		return 0, stats, nil
+	}
+
+	query := `INSERT INTO login_attempts (email, ip)
+	VALUES ($1, $2)
+	RETURNING id`
+
+	var id int64
+
+	err = tx.QueryRowContext(ctx, query, email, ip).Scan(&id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, stats, nil
+}
+
+// Exists reports whether the attempt is still recorded. Attempts are deleted
+// once a login for the address succeeds or its lockout is lifted.
+func (m LoginAttemptModel) Exists(id int64) (bool, error) {
+	query := `SELECT EXISTS(SELECT 1 FROM login_attempts WHERE id = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&exists)
+	return exists, err
+}
+
+// Stats counts the failed logins for the email address and the IP address
+// since the given time.
+func (m LoginAttemptModel) Stats(email, ip string, since time.Time) (*LoginAttemptStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return loginAttemptStats(ctx, m.DB, email, ip, since)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func loginAttemptStats(ctx context.Context, db queryRower, email, ip string, since time.Time) (*LoginAttemptStats, error) {
+	query := `
+	SELECT count(*) FILTER (WHERE email = $1),
+		max(created_at) FILTER (WHERE email = $1),
+		count(*) FILTER (WHERE ip = $2)
+	FROM login_attempts
+	WHERE (email = $1 OR ip = $2) AND created_at > $3`
+
+	var stats LoginAttemptStats
+	var lastFailure sql.NullTime
+
+	err := db.QueryRowContext(ctx, query, email, ip, since).Scan(&stats.EmailFailures, &lastFailure, &stats.IPFailures)
+	if err != nil {
+		return nil, err
+	}
+	stats.LastFailure = lastFailure.Time
+
+	return &stats, nil
+}
+
+// DeleteForEmail forgets the failed logins for an email address, lifting any
+// lockout.
+func (m LoginAttemptModel) DeleteForEmail(email string) error {
+	query := `DELETE FROM login_attempts
+	WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email)
+	return err
+}
+
+// DeleteOlderThan removes failed logins too old to count any more.
+func (m LoginAttemptModel) DeleteOlderThan(t time.Time) (int64, error) {
+	query := `DELETE FROM login_attempts
+	WHERE created_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -3,6 +3,8 @@ package data
 import (
 	"database/sql"
 	"errors"
+
+	"github.com/kcharymyrat/greenlight/internal/cache"
 )
 
 var (
@@ -11,17 +13,31 @@ var (
 )
 
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	APIKeys       APIKeyModel
+	Audit         AuditModel
+	LoginAttempts LoginAttemptModel
+	Movies        MovieModel
+	OAuth         OAuthModel
+	Permissions   PermissionModel
+	Revocations   RevocationModel
+	Roles         RoleModel
+	TOTP          TOTPModel
+	Tokens        TokenModel
+	Users         UserModel
 }
 
 func NewModel(db *sql.DB) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db, touched: cache.New[int64, struct{}](10_000, touchInterval)},
+		Audit:         AuditModel{DB: db},
+		LoginAttempts: LoginAttemptModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		OAuth:         OAuthModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Revocations:   RevocationModel{DB: db, Denylist: NewDenylist()},
+		Roles:         RoleModel{DB: db},
+		TOTP:          TOTPModel{DB: db},
+		Tokens:        TokenModel{DB: db, touched: cache.New[string, struct{}](10_000, touchInterval)},
+		Users:         UserModel{DB: db},
 	}
 }
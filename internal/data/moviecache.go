@@ -0,0 +1,63 @@
+package data
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/cache"
+	"golang.org/x/sync/singleflight"
+)
+
+// MovieInvalidationChannel is the PostgreSQL NOTIFY channel on which the
+// movies table trigger publishes the ID of every updated or deleted movie.
+const MovieInvalidationChannel = "movie_invalidations"
+
+// MovieCache is a read-through cache in front of MovieModel.Get. Concurrent
+// misses for the same movie are coalesced into a single query.
+type MovieCache struct {
+	entries *cache.Cache[int64, Movie]
+	group   singleflight.Group
+}
+
+func NewMovieCache(capacity int, ttl time.Duration) *MovieCache {
+	return &MovieCache{
+		entries: cache.New[int64, Movie](capacity, ttl),
+	}
+}
+
+func (c *MovieCache) Invalidate(id int64) {
+	c.entries.Remove(id)
+}
+
+func (c *MovieCache) Purge() {
+	c.entries.Purge()
+}
+
+func (c *MovieCache) Stats() cache.Stats {
+	return c.entries.Stats()
+}
+
+func (c *MovieCache) get(id int64, load func(int64) (*Movie, error)) (*Movie, error) {
+	if movie, ok := c.entries.Get(id); ok {
+		return movie.clone(), nil
+	}
+
+	v, err, _ := c.group.Do(strconv.FormatInt(id, 10), func() (interface{}, error) {
+		generation := c.entries.Generation()
+
+		movie, err := load(id)
+		if err != nil {
+			return nil, err
+		}
+
+		c.entries.SetIfGeneration(id, *movie, generation)
+		return movie, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The loaded movie is shared between all coalesced callers, so each of
+	// them gets its own copy to modify.
+	return v.(*Movie).clone(), nil
+}
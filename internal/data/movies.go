@@ -15,6 +15,8 @@ import (
 type Movie struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	CreatedBy int64     `json:"-"`
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty,string"`
@@ -40,21 +42,31 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
+// clone returns a deep copy of the movie, so that cached values are never
+// modified by callers.
+func (movie Movie) clone() *Movie {
+	if movie.Genres != nil {
+		movie.Genres = append([]string{}, movie.Genres...)
+	}
+	return &movie
+}
+
 type MovieModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *MovieCache
 }
 
 func (m MovieModel) Insert(movie *Movie) error {
-	query := `INSERT INTO movies (title, year, runtime, genres)
-	VALUES ($1, $2, $3, $4)
-	RETURNING id, created_at, version`
+	query := `INSERT INTO movies (title, year, runtime, genres, created_by)
+	VALUES ($1, $2, $3, $4, NULLIF($5, 0))
+	RETURNING id, created_at, updated_at, version`
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
 }
 
 func (m MovieModel) Get(id int64) (*Movie, error) {
@@ -62,7 +74,15 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `SELECT id, created_at, title, year, runtime, genres, version
+	if m.Cache != nil {
+		return m.Cache.get(id, m.get)
+	}
+
+	return m.get(id)
+}
+
+func (m MovieModel) get(id int64) (*Movie, error) {
+	query := `SELECT id, created_at, updated_at, COALESCE(created_by, 0), title, year, runtime, genres, version
 	FROM movies WHERE id = $1`
 
 	var mv Movie
@@ -71,7 +91,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	defer cancel()
 
 	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(&mv.ID, &mv.CreatedAt, &mv.Title, &mv.Year, &mv.Runtime, pq.Array(&mv.Genres), &mv.Version)
+	err := row.Scan(&mv.ID, &mv.CreatedAt, &mv.UpdatedAt, &mv.CreatedBy, &mv.Title, &mv.Year, &mv.Runtime, pq.Array(&mv.Genres), &mv.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -86,9 +106,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 func (m MovieModel) Update(movie *Movie) error {
 	query := `UPDATE movies 
-	SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
+	SET title = $1, year = $2, runtime = $3, genres = $4, updated_at = NOW(), version = version + 1
 	WHERE id = $5 AND version = $6
-	RETURNING version`
+	RETURNING updated_at, version`
 	args := []interface{}{
 		movie.Title,
 		movie.Year,
@@ -101,7 +121,7 @@ func (m MovieModel) Update(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -111,6 +131,10 @@ func (m MovieModel) Update(movie *Movie) error {
 		}
 	}
 
+	if m.Cache != nil {
+		m.Cache.Invalidate(movie.ID)
+	}
+
 	return nil
 }
 
@@ -138,11 +162,35 @@ func (m MovieModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
+	if m.Cache != nil {
+		m.Cache.Invalidate(id)
+	}
+
 	return nil
 }
 
+// LastChanged returns when a movie was last inserted, updated or deleted. The
+// zero time is returned if that isn't known.
+func (m MovieModel) LastChanged() (time.Time, error) {
+	query := `SELECT changed_at
+	FROM table_changes
+	WHERE table_name = 'movies'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var changedAt time.Time
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&changedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+
+	return changedAt, nil
+}
+
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version 
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, updated_at, COALESCE(created_by, 0), title, year, runtime, genres, version 
 	FROM movies
 	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
 	AND (genres @> $2 OR $2 = '{}')
@@ -168,6 +216,8 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.CreatedBy,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
@@ -190,3 +240,47 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	return movies, metadata, nil
 }
+
+// GetAllCreatedBy returns every movie created by the user.
+func (m MovieModel) GetAllCreatedBy(userID int64) ([]*Movie, error) {
+	query := `SELECT id, created_at, updated_at, created_by, title, year, runtime, genres, version
+	FROM movies
+	WHERE created_by = $1
+	ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.CreatedBy,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return movies, nil
+}
@@ -0,0 +1,384 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+type OAuthClient struct {
+	ID           int64       `json:"id"`
+	ClientID     string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	Name         string      `json:"name"`
+	UserID       int64       `json:"-"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+	Confidential bool        `json:"confidential"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+// OAuthCode is an authorization code waiting to be exchanged for an access
+// token.
+type OAuthCode struct {
+	ClientID      int64
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// OAuthGrant describes the OAuth access token a request was authenticated
+// with.
+type OAuthGrant struct {
+	ClientID    int64
+	Permissions Permissions
+	IssuedAt    time.Time
+	Expiry      time.Time
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 uri")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		v.Check(ValidRedirectURI(uri), "redirect_uris", "must only contain absolute http(s) uris without a fragment")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+}
+
+// ValidRedirectURI reports whether uri can be registered as a redirection
+// endpoint (RFC 6749 section 3.1.2).
+func ValidRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.Fragment == ""
+}
+
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+// InsertClient registers a client. Confidential clients are given a secret,
+// which is only available on the returned client.
+func (m OAuthModel) InsertClient(client *OAuthClient) error {
+	idBytes := make([]byte, 12)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return err
+	}
+	client.ClientID = "glc_" + hex.EncodeToString(idBytes)
+
+	if client.Confidential {
+		secretBytes := make([]byte, 32)
+		_, err = rand.Read(secretBytes)
+		if err != nil {
+			return err
+		}
+		client.Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secretBytes)
+
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+
+	query := `INSERT INTO oauth_clients (client_id, secret_hash, name, user_id, redirect_uris, scopes)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	args := []interface{}{
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		client.UserID,
+		pq.Array(client.RedirectURIs),
+		pq.Array(client.Scopes),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+// GetClient returns the client with the given public client_id.
+func (m OAuthModel) GetClient(clientID string) (*OAuthClient, error) {
+	clients, err := m.queryClients(`WHERE client_id = $1`, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return clients[0], nil
+}
+
+func (m OAuthModel) GetClientByID(id int64) (*OAuthClient, error) {
+	clients, err := m.queryClients(`WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return clients[0], nil
+}
+
+func (m OAuthModel) GetClientsForUser(userID int64) ([]*OAuthClient, error) {
+	return m.queryClients(`WHERE user_id = $1 ORDER BY id`, userID)
+}
+
+func (m OAuthModel) queryClients(where string, args ...interface{}) ([]*OAuthClient, error) {
+	query := `SELECT id, client_id, secret_hash, name, user_id, redirect_uris, scopes, created_at
+	FROM oauth_clients ` + where
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+
+	for rows.Next() {
+		var client OAuthClient
+		err := rows.Scan(
+			&client.ID,
+			&client.ClientID,
+			&client.SecretHash,
+			&client.Name,
+			&client.UserID,
+			pq.Array(&client.RedirectURIs),
+			pq.Array(&client.Scopes),
+			&client.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		client.Confidential = client.SecretHash != nil
+
+		clients = append(clients, &client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// DeleteClient removes one of the user's clients, along with every code and
+// token issued to it.
+func (m OAuthModel) DeleteClient(userID, id int64) error {
+	query := `DELETE FROM oauth_clients
+	WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// NewCode stores an authorization code and returns its plaintext.
+func (m OAuthModel) NewCode(code *OAuthCode) (string, error) {
+	token, err := generateToken(code.UserID, time.Until(code.Expiry), "")
+	if err != nil {
+		return "", err
+	}
+
+	query := `INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []interface{}{
+		token.Hash,
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		pq.Array(code.Scopes),
+		code.CodeChallenge,
+		code.Expiry,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return token.Plaintext, nil
+}
+
+// UseCode deletes an unexpired authorization code and returns it, so that each
+// code can be exchanged only once.
+func (m OAuthModel) UseCode(plaintext string) (*OAuthCode, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `DELETE FROM oauth_codes
+	WHERE hash = $1
+	RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var code OAuthCode
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array(&code.Scopes),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if time.Now().After(code.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &code, nil
+}
+
+// NewAccessToken issues an access token to the client for acting as the user
+// with at most the given permissions.
+func (m OAuthModel) NewAccessToken(userID, clientID int64, permissions Permissions, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeOAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO tokens (hash, user_id, expiry, scope, client_id, permissions)
+	VALUES ($1, $2, $3, $4, $5, $6)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, clientID, pq.Array(permissions)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// GetForAccessToken returns the user an unexpired OAuth access token was issued
+// for, along with the grant it carries. Like API keys, access tokens stop
+// working while the user's account is scheduled for deletion.
+func (m OAuthModel) GetForAccessToken(plaintext string) (*User, *OAuthGrant, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.deactivated_at IS NOT NULL, users.version,
+		tokens.client_id, tokens.permissions, tokens.created_at, tokens.expiry
+	FROM users
+	INNER JOIN tokens
+	ON users.id = tokens.user_id
+	WHERE tokens.hash = $1
+	AND tokens.scope = $2
+	AND tokens.expiry > $3
+	AND users.deletion_scheduled_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	var grant OAuthGrant
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], ScopeOAuth, time.Now()).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+		&grant.ClientID,
+		pq.Array(&grant.Permissions),
+		&grant.IssuedAt,
+		&grant.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return &user, &grant, nil
+}
+
+// RevokeAccessToken deletes an access token issued to the client. Tokens that
+// don't exist or belong to another client are ignored.
+func (m OAuthModel) RevokeAccessToken(clientID int64, plaintext string) error {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `DELETE FROM tokens
+	WHERE hash = $1 AND scope = $2 AND client_id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash[:], ScopeOAuth, clientID)
+	return err
+}
+
+// DeleteExpiredCodes removes authorization codes that were never exchanged.
+func (m OAuthModel) DeleteExpiredCodes() (int64, error) {
+	query := `DELETE FROM oauth_codes
+	WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
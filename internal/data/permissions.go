@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -10,25 +11,115 @@ import (
 
 type Permissions []string
 
+// permissionImplications maps a permission code to the codes that holding it
+// implies. Implications are transitive.
+var permissionImplications = map[string][]string{
+	"movies:write":     {"movies:read", "movies:write:own"},
+	"movies:write:own": {"movies:read"},
+}
+
+// Include reports whether the permissions grant code, either directly, through
+// a wildcard pattern such as "movies:*" or "*", or through the implication
+// graph.
 func (p Permissions) Include(code string) bool {
-	for i := range p {
-		if code == p[i] {
+	for _, granted := range p.expand() {
+		if MatchPermission(granted, code) {
 			return true
 		}
 	}
 	return false
 }
 
+// expand returns the permissions together with every code they transitively
+// imply.
+func (p Permissions) expand() []string {
+	seen := make(map[string]bool, len(p))
+	expanded := make([]string, 0, len(p))
+
+	queue := append([]string{}, p...)
+	for len(queue) > 0 {
+		code := queue[0]
+		queue = queue[1:]
+
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		expanded = append(expanded, code)
+
+		queue = append(queue, permissionImplications[code]...)
+	}
+
+	return expanded
+}
+
+// Intersect returns the permissions granted by both p and other. Wildcards are
+// narrowed to whatever the other side grants, so intersecting "movies:*" with
+// "movies:read" gives "movies:read".
+func (p Permissions) Intersect(other Permissions) Permissions {
+	seen := make(map[string]bool)
+	var result Permissions
+
+	for _, code := range p.expand() {
+		if other.Include(code) && !seen[code] {
+			seen[code] = true
+			result = append(result, code)
+		}
+	}
+	for _, code := range other.expand() {
+		if p.Include(code) && !seen[code] {
+			seen[code] = true
+			result = append(result, code)
+		}
+	}
+
+	return result
+}
+
+// MatchPermission reports whether a granted permission pattern covers code.
+// The pattern "*" matches every code, and a pattern ending in ":*" matches every
+// code starting with the part before the "*" (so "movies:*" matches
+// "movies:read" and "movies:write:own" but not "movies").
+func MatchPermission(pattern, code string) bool {
+	if pattern == "*" || pattern == code {
+		return true
+	}
+
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasSuffix(prefix, ":") {
+		return strings.HasPrefix(code, prefix) && len(code) > len(prefix)
+	}
+
+	return false
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	if m.Cache != nil {
+		return m.Cache.getPermissions(userID, func() (Permissions, error) {
+			return m.getAllForUser(userID)
+		})
+	}
+
+	return m.getAllForUser(userID)
+}
+
+func (m PermissionModel) getAllForUser(userID int64) (Permissions, error) {
+	// The user's permissions are the union of those granted directly and those
+	// derived from their roles.
 	query := `SELECT permissions.code
 	FROM permissions
 	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-	INNER JOIN users ON users_permissions.user_id = users.id
-	WHERE users.id = $1`
+	WHERE users_permissions.user_id = $1
+	UNION
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN role_permissions ON role_permissions.permission_id = permissions.id
+	INNER JOIN users_roles ON users_roles.role_id = role_permissions.role_id
+	WHERE users_roles.user_id = $1`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -60,11 +151,74 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 	INSERT INTO users_permissions
-	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+	ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+	DELETE FROM users_permissions
+	USING permissions
+	WHERE users_permissions.permission_id = permissions.id
+	AND users_permissions.user_id = $1
+	AND permissions.code = ANY($2)`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+// GetAll returns every permission code that can be granted.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
 }
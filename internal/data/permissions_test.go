@@ -0,0 +1,126 @@
+package data
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		pattern string
+		code    string
+		want    bool
+	}{
+		{"movies:read", "movies:read", true},
+		{"movies:read", "movies:write", false},
+		{"movies:read", "movies:read:own", false},
+		{"*", "movies:read", true},
+		{"*", "users:admin", true},
+		{"movies:*", "movies:read", true},
+		{"movies:*", "movies:write:own", true},
+		{"movies:*", "movies", false},
+		{"movies:*", "movies:", false},
+		{"movies:*", "users:admin", false},
+		{"movies:*", "moviesx:read", false},
+		{"movies", "movies:read", false},
+		{"movies*", "movies:read", false},
+		{"movies:write:*", "movies:write:own", true},
+		{"movies:write:*", "movies:write", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.code, func(t *testing.T) {
+			if got := MatchPermission(tt.pattern, tt.code); got != tt.want {
+				t.Errorf("MatchPermission(%q, %q) = %v; want %v", tt.pattern, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsInclude(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		code        string
+		want        bool
+	}{
+		{"exact", Permissions{"movies:read"}, "movies:read", true},
+		{"missing", Permissions{"movies:read"}, "users:admin", false},
+		{"empty", nil, "movies:read", false},
+		{"wildcard", Permissions{"movies:*"}, "movies:write", true},
+		{"global wildcard", Permissions{"*"}, "metrics:view", true},
+		{"wildcard doesn't match bare prefix", Permissions{"movies:*"}, "movies", false},
+		{"bare prefix doesn't match", Permissions{"movies"}, "movies:read", false},
+		{"direct implication", Permissions{"movies:write:own"}, "movies:read", true},
+		{"implication", Permissions{"movies:write"}, "movies:write:own", true},
+		{"chained implication", Permissions{"movies:write"}, "movies:read", true},
+		{"implications only go one way", Permissions{"movies:read"}, "movies:write:own", false},
+		{"own doesn't imply all", Permissions{"movies:write:own"}, "movies:write", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.permissions.Include(tt.code); got != tt.want {
+				t.Errorf("%v.Include(%q) = %v; want %v", tt.permissions, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsExpand(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		want        []string
+	}{
+		{"no implications", Permissions{"users:admin"}, []string{"users:admin"}},
+		{"chain", Permissions{"movies:write"}, []string{"movies:write", "movies:read", "movies:write:own"}},
+		{"duplicates", Permissions{"movies:write:own", "movies:read"}, []string{"movies:write:own", "movies:read"}},
+		{"empty", nil, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.permissions.expand(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%v.expand() = %v; want %v", tt.permissions, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsIntersect(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     Permissions
+		other Permissions
+		want  []string
+	}{
+		{"disjoint", Permissions{"movies:read"}, Permissions{"users:admin"}, nil},
+		{"exact", Permissions{"movies:read", "users:admin"}, Permissions{"movies:read"}, []string{"movies:read"}},
+		{"wildcard narrowed", Permissions{"movies:*"}, Permissions{"movies:read"}, []string{"movies:read"}},
+		{"wildcard narrowed either side", Permissions{"movies:read"}, Permissions{"movies:*"}, []string{"movies:read"}},
+		{"global wildcard", Permissions{"*"}, Permissions{"movies:write:own", "metrics:view"}, []string{"metrics:view", "movies:read", "movies:write:own"}},
+		{"both wildcards", Permissions{"*"}, Permissions{"movies:*"}, []string{"movies:*"}},
+		{"implication narrowed", Permissions{"movies:write"}, Permissions{"movies:read"}, []string{"movies:read"}},
+		{"implication kept", Permissions{"movies:write:own"}, Permissions{"movies:write"}, []string{"movies:read", "movies:write:own"}},
+		{"wildcard with implication", Permissions{"movies:*"}, Permissions{"movies:write"}, []string{"movies:read", "movies:write", "movies:write:own"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.p.Intersect(tt.other)
+
+			gotSorted := append([]string{}, got...)
+			sort.Strings(gotSorted)
+			want := tt.want
+			if want == nil {
+				want = []string{}
+			}
+
+			if !reflect.DeepEqual(gotSorted, want) {
+				t.Errorf("%v.Intersect(%v) = %v; want %v", tt.p, tt.other, got, tt.want)
+			}
+		})
+	}
+}
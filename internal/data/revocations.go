@@ -0,0 +1,196 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// RevocationChannel is the PostgreSQL NOTIFY channel on which the revoked_tokens
+// trigger announces new revocations.
+const RevocationChannel = "token_revocations"
+
+type userRevocation struct {
+	revokedAt time.Time
+	expiry    time.Time
+}
+
+// Denylist is the in-memory copy of the revoked_tokens table, consulted when
+// verifying stateless tokens so that no query is needed per request.
+type Denylist struct {
+	mu     sync.RWMutex
+	tokens map[string]time.Time
+	users  map[int64]userRevocation
+}
+
+func NewDenylist() *Denylist {
+	return &Denylist{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int64]userRevocation),
+	}
+}
+
+// IsRevoked reports whether the token with the given ID, issued to the user at
+// issuedAt, has been revoked.
+func (d *Denylist) IsRevoked(jti string, userID int64, issuedAt time.Time) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if _, ok := d.tokens[jti]; ok {
+		return true
+	}
+	if revocation, ok := d.users[userID]; ok && !issuedAt.After(revocation.revokedAt) {
+		return true
+	}
+	return false
+}
+
+func (d *Denylist) addToken(jti string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tokens[jti] = expiry
+}
+
+func (d *Denylist) addUser(userID int64, revokedAt, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if current, ok := d.users[userID]; ok && current.revokedAt.After(revokedAt) {
+		return
+	}
+	d.users[userID] = userRevocation{revokedAt: revokedAt, expiry: expiry}
+}
+
+func (d *Denylist) replace(tokens map[string]time.Time, users map[int64]userRevocation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tokens = tokens
+	d.users = users
+}
+
+// prune forgets revocations of tokens that expired before now.
+func (d *Denylist) prune(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for jti, expiry := range d.tokens {
+		if expiry.Before(now) {
+			delete(d.tokens, jti)
+		}
+	}
+	for userID, revocation := range d.users {
+		if revocation.expiry.Before(now) {
+			delete(d.users, userID)
+		}
+	}
+}
+
+type RevocationModel struct {
+	DB       *sql.DB
+	Denylist *Denylist
+}
+
+// RevokeToken adds a single stateless token to the denylist until it expires.
+func (m RevocationModel) RevokeToken(jti string, userID int64, expiry time.Time) error {
+	query := `INSERT INTO revoked_tokens (jti, user_id, expiry)
+	VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jti, userID, expiry)
+	if err != nil {
+		return err
+	}
+
+	m.Denylist.addToken(jti, expiry)
+	return nil
+}
+
+// RevokeUser revokes every stateless token issued to the user so far. The entry
+// is kept until expiry, by which time all of those tokens have expired anyway.
+func (m RevocationModel) RevokeUser(userID int64, expiry time.Time) error {
+	query := `INSERT INTO revoked_tokens (user_id, expiry)
+	VALUES ($1, $2)
+	RETURNING revoked_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var revokedAt time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, userID, expiry).Scan(&revokedAt)
+	if err != nil {
+		return err
+	}
+
+	m.Denylist.addUser(userID, revokedAt, expiry)
+	return nil
+}
+
+// Load replaces the in-memory denylist with the unexpired revocations in the
+// database.
+func (m RevocationModel) Load() error {
+	query := `SELECT COALESCE(jti, ''), user_id, revoked_at, expiry
+	FROM revoked_tokens
+	WHERE expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tokens := make(map[string]time.Time)
+	users := make(map[int64]userRevocation)
+
+	for rows.Next() {
+		var jti string
+		var userID int64
+		var revokedAt, expiry time.Time
+
+		err := rows.Scan(&jti, &userID, &revokedAt, &expiry)
+		if err != nil {
+			return err
+		}
+
+		if jti != "" {
+			tokens[jti] = expiry
+			continue
+		}
+		if current, ok := users[userID]; !ok || revokedAt.After(current.revokedAt) {
+			users[userID] = userRevocation{revokedAt: revokedAt, expiry: expiry}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	m.Denylist.replace(tokens, users)
+	return nil
+}
+
+// DeleteExpired removes revocations of tokens that have since expired, from
+// both the database and the in-memory denylist.
+func (m RevocationModel) DeleteExpired() (int64, error) {
+	query := `DELETE FROM revoked_tokens
+	WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	m.Denylist.prune(time.Now())
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,329 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kcharymyrat/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+	ErrUnknownRole       = errors.New("unknown role")
+)
+
+// Role is a named bundle of permissions that can be assigned to users.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+type RoleModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// Insert creates the role together with its permissions, so that a failure
+// never leaves a role behind with only some of them.
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO roles (name)
+	VALUES ($1)
+	RETURNING id`
+
+	err = tx.QueryRowContext(ctx, query, role.Name).Scan(&role.ID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	if len(role.Permissions) > 0 {
+		_, err = tx.ExecContext(ctx, addRolePermissionsQuery, role.ID, pq.Array(role.Permissions))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	roles, err := m.query(`WHERE roles.id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return roles[0], nil
+}
+
+func (m RoleModel) GetByName(name string) (*Role, error) {
+	roles, err := m.query(`WHERE roles.name = $1`, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return roles[0], nil
+}
+
+func (m RoleModel) GetAll() ([]*Role, error) {
+	return m.query(``)
+}
+
+// GetUserIDs returns the IDs of the users holding the role.
+func (m RoleModel) GetUserIDs(roleID int64) ([]int64, error) {
+	query := `SELECT user_id FROM users_roles
+	WHERE role_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int64
+
+	for rows.Next() {
+		var userID int64
+		err := rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	return m.query(`INNER JOIN users_roles ON users_roles.role_id = roles.id
+	WHERE users_roles.user_id = $1`, userID)
+}
+
+// query returns the roles matching the given join/where clause together with
+// their permission codes.
+func (m RoleModel) query(clause string, args ...interface{}) ([]*Role, error) {
+	query := `SELECT roles.id, roles.name,
+	COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+	FROM roles
+	LEFT JOIN role_permissions ON role_permissions.role_id = roles.id
+	LEFT JOIN permissions ON permissions.id = role_permissions.permission_id
+	` + clause + `
+	GROUP BY roles.id
+	ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+		var codes []string
+
+		err := rows.Scan(&role.ID, &role.Name, pq.Array(&codes))
+		if err != nil {
+			return nil, err
+		}
+
+		role.Permissions = Permissions(codes)
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM roles WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected < 1 {
+		return ErrRecordNotFound
+	}
+
+	m.purgeCache()
+
+	return nil
+}
+
+const addRolePermissionsQuery = `
+	INSERT INTO role_permissions
+	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+	ON CONFLICT DO NOTHING`
+
+func (m RoleModel) AddPermissions(roleID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, addRolePermissionsQuery, roleID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	m.purgeCache()
+
+	return nil
+}
+
+func (m RoleModel) RemovePermissions(roleID int64, codes ...string) error {
+	query := `
+	DELETE FROM role_permissions
+	USING permissions
+	WHERE role_permissions.permission_id = permissions.id
+	AND role_permissions.role_id = $1
+	AND permissions.code = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, roleID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	m.purgeCache()
+
+	return nil
+}
+
+// addUserRoles assigns the named roles to the user. If any of the names is
+// unknown nothing is assigned and ErrUnknownRole is returned.
+func addUserRoles(ctx context.Context, db queryRower, userID int64, names ...string) error {
+	query := `
+	WITH found AS (
+		SELECT id FROM roles WHERE name = ANY($2)
+	), inserted AS (
+		INSERT INTO users_roles
+		SELECT $1, id FROM found
+		WHERE (SELECT count(*) FROM found) = $3
+		ON CONFLICT DO NOTHING
+	)
+	SELECT count(*) FROM found`
+
+	unique := make(map[string]bool, len(names))
+	for _, name := range names {
+		unique[name] = true
+	}
+
+	var found int
+	err := db.QueryRowContext(ctx, query, userID, pq.Array(names), len(unique)).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != len(unique) {
+		return ErrUnknownRole
+	}
+
+	return nil
+}
+
+// AddForUser assigns the named roles to the user. If any of the names is
+// unknown nothing is assigned and ErrUnknownRole is returned.
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := addUserRoles(ctx, m.DB, userID, names...)
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	query := `
+	DELETE FROM users_roles
+	USING roles
+	WHERE users_roles.role_id = roles.id
+	AND users_roles.user_id = $1
+	AND roles.name = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+// purgeCache drops all cached permissions, since a change to a role affects
+// every user holding it.
+func (m RoleModel) purgeCache() {
+	if m.Cache != nil {
+		m.Cache.PurgePermissions()
+	}
+}
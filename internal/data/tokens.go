@@ -6,25 +6,67 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"github.com/kcharymyrat/greenlight/internal/cache"
 	"github.com/kcharymyrat/greenlight/internal/validator"
+	"github.com/lib/pq"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeTOTPChallenge  = "totp-challenge"
+	ScopeMagicLink      = "magic-link"
+	ScopeOAuth          = "oauth"
+	ScopeUnlock         = "unlock"
 )
 
+var ErrTokenReused = errors.New("token reused")
+
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	NewEmail  string    `json:"-"`
+	IP        string    `json:"-"`
+	UserAgent string    `json:"-"`
+	FamilyID  int64     `json:"-"`
+}
+
+// TokenMetadata describes a stored token without its hash, for including in a
+// user's personal data export.
+type TokenMetadata struct {
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	NewEmail   string     `json:"new_email,omitempty"`
 }
 
+// Session is a login as shown to its owner. Logins that issued a refresh token
+// are represented by the family's current refresh token.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+}
+
+// touchInterval limits how often a token's last-used time is written.
+const touchInterval = time.Minute
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
 		UserID: userID,
@@ -56,7 +98,11 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
+
+	// touched records the tokens whose last-used time was written recently.
+	touched *cache.Cache[string, struct{}]
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -69,11 +115,49 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewEmailChange creates a token which, when redeemed, changes the user's email
+// address to newEmail.
+func (m TokenModel) NewEmailChange(userID int64, ttl time.Duration, newEmail string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.NewEmail = newEmail
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewSession creates a token recording the IP address and user agent of the
+// client it was issued to. Tokens issued for the same login share a familyID,
+// which may be zero if the token has no family.
+func (m TokenModel) NewSession(userID int64, ttl time.Duration, scope string, familyID int64, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.FamilyID = familyID
+	token.IP = ip
+	token.UserAgent = userAgent
+
+	err = m.Insert(token)
+	return token, err
+}
+
 func (m TokenModel) Insert(token *Token) error {
-	query := `INSERT INTO tokens(hash, user_id, expiry, scope)
-	VALUES ($1, $2, $3, $4)`
+	query := `INSERT INTO tokens(hash, user_id, expiry, scope, new_email, ip, user_agent, family_id)
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, NULLIF($8, 0))`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{
+		token.Hash,
+		token.UserID,
+		token.Expiry,
+		token.Scope,
+		token.NewEmail,
+		token.IP,
+		token.UserAgent,
+		token.FamilyID,
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -90,5 +174,387 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+func (m TokenModel) DeleteAllScopesForUser(userID int64) error {
+	query := `DELETE FROM tokens
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+func (m TokenModel) GetAllForUser(userID int64) ([]*TokenMetadata, error) {
+	query := `SELECT scope, created_at, last_used_at, expiry, ip, user_agent, COALESCE(new_email, '')
+	FROM tokens
+	WHERE user_id = $1
+	ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*TokenMetadata{}
+
+	for rows.Next() {
+		var token TokenMetadata
+		err := rows.Scan(
+			&token.Scope,
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.Expiry,
+			&token.IP,
+			&token.UserAgent,
+			&token.NewEmail,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Touch records that the token was just used. Writes are limited to one per
+// token every touchInterval.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	key := string(tokenHash[:])
+
+	if m.touched != nil {
+		if _, ok := m.touched.Get(key); ok {
+			return nil
+		}
+		m.touched.Set(key, struct{}{})
+	}
+
+	query := `UPDATE tokens
+	SET last_used_at = NOW()
+	WHERE hash = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
 	return err
 }
+
+// NewFamily returns an ID for grouping the tokens issued by a single login.
+func (m TokenModel) NewFamily() (int64, error) {
+	query := `SELECT nextval('token_families_seq')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var familyID int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&familyID)
+	return familyID, err
+}
+
+// UseRefreshToken marks a refresh token as used and returns it. A refresh token
+// can only be used once: presenting one that has already been used revokes
+// every token in its family, records the reuse in the audit log and returns
+// ErrTokenReused, since either the client or an attacker is holding a stolen
+// copy.
+func (m TokenModel) UseRefreshToken(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `SELECT user_id, expiry, COALESCE(family_id, 0), used_at IS NOT NULL
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > $3
+	FOR UPDATE`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token := Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+		Scope:     ScopeRefresh,
+	}
+	var used bool
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh, time.Now()).Scan(
+		&token.UserID,
+		&token.Expiry,
+		&token.FamilyID,
+		&used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if used {
+		hashes, err := deleteTokens(ctx, tx, `DELETE FROM tokens WHERE family_id = $1 RETURNING hash`, token.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Record the reuse along with the revocation, so that one never
+		// happens without the other.
+		_, err = tx.ExecContext(ctx, `INSERT INTO audit_events (type, subject_id, details)
+		VALUES ($1, $2, jsonb_build_object('family_id', $3::bigint))`, AuditRefreshTokenReused, token.UserID, token.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		m.invalidateTokens(hashes)
+		return nil, ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Delete removes the token with the given plaintext, along with every other
+// token issued for the same login.
+func (m TokenModel) Delete(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `DELETE FROM tokens
+	WHERE hash = $1 OR family_id = (SELECT family_id FROM tokens WHERE hash = $1)
+	RETURNING hash`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hashes, err := deleteTokens(ctx, m.DB, query, tokenHash[:])
+	if err != nil {
+		return err
+	}
+
+	m.invalidateTokens(hashes)
+	return nil
+}
+
+// DeleteSessionsForUser logs the user out everywhere by deleting their
+// authentication, refresh and OAuth access tokens.
+func (m TokenModel) DeleteSessionsForUser(userID int64) error {
+	query := `DELETE FROM tokens
+	WHERE user_id = $1 AND scope = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array([]string{ScopeAuthentication, ScopeRefresh, ScopeOAuth}))
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+// DeleteOtherSessionsForUser logs the user out everywhere except from the
+// session that currentPlaintext belongs to, which may be empty to log out of
+// every session.
+func (m TokenModel) DeleteOtherSessionsForUser(userID int64, currentPlaintext string) error {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	query := `DELETE FROM tokens
+	WHERE user_id = $1 AND scope = ANY($2) AND hash <> $3
+	AND (family_id IS NULL OR family_id IS DISTINCT FROM (SELECT c.family_id FROM tokens c WHERE c.hash = $3))
+	RETURNING hash`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hashes, err := deleteTokens(ctx, m.DB, query, userID, pq.Array([]string{ScopeAuthentication, ScopeRefresh, ScopeOAuth}), currentHash[:])
+	if err != nil {
+		return err
+	}
+
+	m.invalidateTokens(hashes)
+	return nil
+}
+
+// GetSessionsForUser returns the user's current logins. The session that
+// currentPlaintext belongs to is marked as current.
+func (m TokenModel) GetSessionsForUser(userID int64, currentPlaintext string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	// A family's creation and last use are taken from all of its tokens, since
+	// each refresh replaces both the access and the refresh token.
+	query := `SELECT t.id,
+		COALESCE((SELECT MIN(f.created_at) FROM tokens f WHERE f.family_id = t.family_id), t.created_at),
+		COALESCE((SELECT MAX(f.last_used_at) FROM tokens f WHERE f.family_id = t.family_id), t.last_used_at),
+		t.expiry, t.ip, t.user_agent,
+		t.hash = $4 OR t.family_id = (SELECT c.family_id FROM tokens c WHERE c.hash = $4)
+	FROM tokens t
+	WHERE t.user_id = $1 AND t.expiry > NOW() AND (
+		(t.scope = $2 AND t.family_id IS NULL) OR
+		(t.scope = $3 AND t.used_at IS NULL)
+	)
+	ORDER BY 2 DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, ScopeRefresh, currentHash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+		var current sql.NullBool
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		session.Current = current.Bool
+
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession revokes one of the user's logins by its session ID.
+func (m TokenModel) DeleteSession(userID, id int64) error {
+	query := `DELETE FROM tokens
+	WHERE user_id = $2 AND (
+		(id = $1 AND scope = ANY($3)) OR
+		family_id = (SELECT family_id FROM tokens WHERE id = $1 AND user_id = $2)
+	)
+	RETURNING hash`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hashes, err := deleteTokens(ctx, m.DB, query, id, userID, pq.Array([]string{ScopeAuthentication, ScopeRefresh}))
+	if err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return ErrRecordNotFound
+	}
+
+	m.invalidateTokens(hashes)
+	return nil
+}
+
+func (m TokenModel) invalidateTokens(hashes [][]byte) {
+	if m.Cache == nil {
+		return
+	}
+	for _, hash := range hashes {
+		m.Cache.InvalidateToken(hash)
+	}
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// deleteTokens runs a DELETE ... RETURNING hash query and collects the hashes
+// of the deleted tokens.
+func deleteTokens(ctx context.Context, db queryer, query string, args ...interface{}) ([][]byte, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes [][]byte
+
+	for rows.Next() {
+		var hash []byte
+		err := rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// DeleteExpired removes every expired token and returns how many there were.
+func (m TokenModel) DeleteExpired() (int64, error) {
+	query := `DELETE FROM tokens
+	WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,267 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is the number of recovery codes generated at a time.
+const recoveryCodeCount = 10
+
+var ErrTOTPAlreadyEnabled = errors.New("totp already enabled")
+
+type TOTP struct {
+	UserID      int64
+	Secret      string
+	Confirmed   bool
+	LastCounter int64
+}
+
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Get returns the user's TOTP enrollment, confirmed or not.
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `SELECT user_id, secret, confirmed, last_counter
+	FROM users_totp
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t TOTP
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.Confirmed, &t.LastCounter)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// IsEnabled reports whether the user has confirmed TOTP enrollment.
+func (m TOTPModel) IsEnabled(userID int64) (bool, error) {
+	t, err := m.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return t.Confirmed, nil
+}
+
+// RecoveryCodesRemaining returns how many of the user's recovery codes haven't
+// been used yet.
+func (m TOTPModel) RecoveryCodesRemaining(userID int64) (int, error) {
+	query := `SELECT count(*)
+	FROM recovery_codes
+	WHERE user_id = $1 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var remaining int
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&remaining)
+	if err != nil {
+		return 0, err
+	}
+
+	return remaining, nil
+}
+
+// Enroll stores a new, unconfirmed secret for the user, replacing any earlier
+// unconfirmed one.
+func (m TOTPModel) Enroll(userID int64, secret string) error {
+	query := `INSERT INTO users_totp (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET secret = EXCLUDED.secret, last_counter = 0, created_at = NOW()
+	WHERE users_totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	return nil
+}
+
+// Confirm enables TOTP for the user once they have proved that their
+// authenticator app produces valid codes.
+func (m TOTPModel) Confirm(userID, counter int64) error {
+	query := `UPDATE users_totp
+	SET confirmed = true, last_counter = $2
+	WHERE user_id = $1 AND confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// UseCounter records that the code for the given time step has been used. It
+// returns false if that code, or a later one, was already used.
+func (m TOTPModel) UseCounter(userID, counter int64) (bool, error) {
+	query := `UPDATE users_totp
+	SET last_counter = $2
+	WHERE user_id = $1 AND last_counter < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, counter)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// Disable removes the user's TOTP secret and recovery codes.
+func (m TOTPModel) Disable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// NewRecoveryCodes replaces the user's recovery codes with a fresh set and
+// returns their plaintext, which can't be retrieved again later.
+func (m TOTPModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+		codes[i] = code[:8] + "-" + code[8:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		hash := hashRecoveryCode(code)
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used,
+// returning false if the code doesn't match any of them.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `UPDATE recovery_codes
+	SET used_at = NOW()
+	WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// hashRecoveryCode normalizes a recovery code, so that it may be entered with
+// or without the dash and in any case, and hashes it.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
@@ -5,11 +5,14 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/kcharymyrat/greenlight/internal/passhash"
+	"github.com/kcharymyrat/greenlight/internal/passpolicy"
 	"github.com/kcharymyrat/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -19,28 +22,47 @@ var (
 var AnonymousUser = &User{}
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	Email       string    `json:"email"`
+	Password    password  `json:"-"`
+	Activated   bool      `json:"activated"`
+	Deactivated bool      `json:"deactivated"`
+	Version     int       `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// clone returns a deep copy of the user, so that cached values are never
+// modified by callers.
+func (u User) clone() *User {
+	if u.Password.hash != nil {
+		u.Password.hash = append([]byte{}, u.Password.hash...)
+	}
+	u.Password.plaintext = nil
+	return &u
+}
+
+// PasswordParams are the algorithm and cost new password hashes are created
+// with. It is set from the configuration at startup.
+var PasswordParams = passhash.DefaultParams
+
+// PasswordPolicy is the policy new passwords must follow. It is set from the
+// configuration at startup.
+var PasswordPolicy = passpolicy.Policy{MinLength: 8}
+
 type password struct {
 	plaintext *string
 	hash      []byte
 }
 
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := passhash.Hash(plaintextPassword, PasswordParams)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	p.plaintext = &plaintextPassword
@@ -50,17 +72,29 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+	return passhash.Verify(plaintextPassword, p.hash)
+}
 
-	return true, nil
+// NeedsRehash reports whether the password was hashed with something other than
+// the current PasswordParams.
+func (p *password) NeedsRehash() bool {
+	return passhash.NeedsRehash(p.hash, PasswordParams)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// SimulatePasswordCheck takes as long as checking a real password does. It is
+// used when there is no account to check against, so that response times don't
+// reveal whether an email address is registered.
+func SimulatePasswordCheck(plaintextPassword string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = passhash.Hash("greenlight-dummy-password", PasswordParams)
+	})
+
+	passhash.Verify(plaintextPassword, dummyHash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -71,7 +105,20 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(strings.TrimSpace(password) != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	if PasswordParams.Algorithm == passhash.Bcrypt {
+		v.Check(len(password) <= passhash.BcryptMaxLength, "password", "must not be more than 72 bytes long")
+	} else {
+		v.Check(len(password) <= 1000, "password", "must not be more than 1000 bytes long")
+	}
+}
+
+// ValidateNewPassword checks a password being set for the user against the
+// PasswordPolicy, as well as ValidatePasswordPlaintext.
+func ValidateNewPassword(v *validator.Validator, password string, user *User) {
+	ValidatePasswordPlaintext(v, password)
+	v.Check(!PasswordPolicy.TooShort(password), "password", fmt.Sprintf("must be at least %d characters long", PasswordPolicy.MinLength))
+	v.Check(!passpolicy.ContainsPersonal(password, user.Name, user.Email), "password", "must not contain your name or email address")
+	v.Check(!PasswordPolicy.IsCommon(password), "password", "is too common or has appeared in a data breach, please choose another")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -79,7 +126,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 	ValidateEmail(v, user.Email)
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidateNewPassword(v, *user.Password.plaintext, user)
 	}
 	if user.Password.hash == nil {
 		panic("missing password hash for user")
@@ -87,12 +134,16 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
-func (m *UserModel) Insert(user *User) error {
-	query := `INSERT INTO users(name, email, password_hash, activated)
-	VALUES ($1, $2, $3, $4)
+// Insert creates the user and assigns them the named roles in one transaction,
+// so that a user is never left without their roles. If any of the roles is
+// unknown the user isn't created and ErrUnknownRole is returned.
+func (m *UserModel) Insert(user *User, roles ...string) error {
+	query := `INSERT INTO users(name, email, password_hash, activated, activated_at)
+	VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END)
 	RETURNING id, created_at, version`
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
@@ -100,8 +151,14 @@ func (m *UserModel) Insert(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	row := m.DB.QueryRowContext(ctx, query, args...)
-	err := row.Scan(&user.ID, &user.CreatedAt, &user.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, query, args...)
+	err = row.Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -111,11 +168,18 @@ func (m *UserModel) Insert(user *User) error {
 		}
 	}
 
-	return nil
+	if len(roles) > 0 {
+		err = addUserRoles(ctx, tx, user.ID, roles...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 func (m *UserModel) GetByEmail(email string) (*User, error) {
-	query := `SELECT id, created_at, name, email, password_hash, activated, version
+	query := `SELECT id, created_at, name, email, password_hash, activated, deactivated_at IS NOT NULL, version
 	FROM users
 	WHERE email = $1`
 
@@ -132,6 +196,7 @@ func (m *UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Deactivated,
 		&user.Version,
 	)
 	if err != nil {
@@ -148,7 +213,8 @@ func (m *UserModel) GetByEmail(email string) (*User, error) {
 
 func (m *UserModel) Update(user *User) error {
 	query := `UPDATE users
-	SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
+	SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1,
+		activated_at = CASE WHEN $4 THEN COALESCE(activated_at, NOW()) ELSE activated_at END
 	WHERE id = $5 and version = $6
 	RETURNING version`
 
@@ -169,19 +235,62 @@ func (m *UserModel) Update(user *User) error {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
 		default:
 			return err
 		}
 	}
 
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(user.ID)
+	}
+
+	return nil
+}
+
+// UpdatePasswordHash stores a new hash of the user's unchanged password, as
+// made after a login when the old hash used outdated parameters. The version
+// isn't incremented, and nothing happens if the user was changed in the
+// meantime.
+func (m *UserModel) UpdatePasswordHash(user *User) error {
+	query := `UPDATE users
+	SET password_hash = $1
+	WHERE id = $2 AND version = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, user.Password.hash, user.ID, user.Version)
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(user.ID)
+	}
+
 	return nil
 }
 
 func (m *UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
+	// Only authentication tokens are looked up repeatedly; the other scopes are
+	// single-use and not worth caching.
+	if m.Cache != nil && tokenScope == ScopeAuthentication {
+		return m.Cache.getUser(tokenHash[:], func() (*User, time.Time, error) {
+			return m.getForToken(tokenScope, tokenHash[:])
+		})
+	}
+
+	user, _, err := m.getForToken(tokenScope, tokenHash[:])
+	return user, err
+}
+
+func (m *UserModel) getForToken(tokenScope string, tokenHash []byte) (*User, time.Time, error) {
 	query := `
-	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.deactivated_at IS NOT NULL, users.version, tokens.expiry
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
@@ -189,9 +298,10 @@ func (m *UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error
 	AND tokens.scope = $2
 	AND tokens.expiry > $3`
 
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	args := []interface{}{tokenHash, tokenScope, time.Now()}
 
 	var user User
+	var expiry time.Time
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -203,9 +313,272 @@ func (m *UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Deactivated,
 		&user.Version,
+		&expiry,
 	)
 
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, time.Time{}, ErrRecordNotFound
+		default:
+			return nil, time.Time{}, err
+		}
+	}
+
+	return &user, expiry, nil
+}
+
+// GetForEmailChangeToken returns the user an email-change token was issued to,
+// along with the new email address stored in the token.
+func (m *UserModel) GetForEmailChangeToken(tokenPlaintext string) (*User, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.deactivated_at IS NOT NULL, users.version, tokens.new_email
+	FROM users
+	INNER JOIN tokens
+	ON users.id = tokens.user_id
+	WHERE tokens.hash = $1
+	AND tokens.scope = $2
+	AND tokens.expiry > $3
+	AND tokens.new_email IS NOT NULL`
+
+	args := []interface{}{tokenHash[:], ScopeEmailChange, time.Now()}
+
+	var user User
+	var newEmail string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+		&newEmail,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "", ErrRecordNotFound
+		default:
+			return nil, "", err
+		}
+	}
+
+	return &user, newEmail, nil
+}
+
+// ScheduleDeletion marks the user's account for hard deletion at the given time.
+func (m *UserModel) ScheduleDeletion(userID int64, at time.Time) error {
+	query := `UPDATE users
+	SET deletion_scheduled_at = $1, version = version + 1
+	WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, at, userID)
+	if err != nil {
+		return err
+	}
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return nil
+}
+
+// IsDeletionScheduled reports whether the user's account is scheduled for
+// deletion.
+func (m *UserModel) IsDeletionScheduled(userID int64) (bool, error) {
+	query := `SELECT deletion_scheduled_at IS NOT NULL
+	FROM users
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var scheduled bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&scheduled)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	return scheduled, nil
+}
+
+// CancelDeletion clears a pending deletion, reporting whether there was one.
+func (m *UserModel) CancelDeletion(userID int64) (bool, error) {
+	query := `UPDATE users
+	SET deletion_scheduled_at = NULL, version = version + 1
+	WHERE id = $1 AND deletion_scheduled_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if rowsAffected > 0 && m.Cache != nil {
+		m.Cache.InvalidateUser(userID)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// Deactivate marks the user's account as deactivated by an admin. A deactivated
+// account can't be activated or logged in to until Reactivate is called.
+func (m *UserModel) Deactivate(user *User) error {
+	query := `UPDATE users
+	SET activated = false, deactivated_at = NOW(), version = version + 1
+	WHERE id = $1 AND version = $2
+	RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	user.Activated = false
+	user.Deactivated = true
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(user.ID)
+	}
+
+	return nil
+}
+
+// Reactivate lifts a deactivation. The account is activated again if it had
+// been activated before it was deactivated.
+func (m *UserModel) Reactivate(user *User) error {
+	query := `UPDATE users
+	SET activated = activated_at IS NOT NULL, deactivated_at = NULL, version = version + 1
+	WHERE id = $1 AND version = $2
+	RETURNING activated, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Activated, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	user.Deactivated = false
+
+	if m.Cache != nil {
+		m.Cache.InvalidateUser(user.ID)
+	}
+
+	return nil
+}
+
+// DeleteScheduled hard-deletes every user whose grace period has passed. All
+// personal data referencing the user is removed by ON DELETE CASCADE, and each
+// deletion is recorded in the audit log.
+func (m *UserModel) DeleteScheduled() (int64, error) {
+	query := `WITH deleted AS (
+		DELETE FROM users
+		WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= NOW()
+		RETURNING id
+	)
+	INSERT INTO audit_events (type, subject_id, details)
+	SELECT $1, id, '{"reason": "deletion requested"}' FROM deleted`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, AuditUserDeleted)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteUnactivated removes accounts that were never activated and were
+// created before the given time, recording each in the audit log. Accounts
+// deactivated by an admin have been activated before, so are kept.
+func (m *UserModel) DeleteUnactivated(createdBefore time.Time) (int64, error) {
+	query := `WITH deleted AS (
+		DELETE FROM users
+		WHERE activated_at IS NULL AND created_at < $1
+		RETURNING id
+	)
+	INSERT INTO audit_events (type, subject_id, details)
+	SELECT $2, id, '{"reason": "never activated"}' FROM deleted`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, createdBefore, AuditUserDeleted)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (m *UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, name, email, password_hash, activated, deactivated_at IS NOT NULL, version
+	FROM users
+	WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Deactivated,
+		&user.Version,
+	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -217,3 +590,57 @@ func (m *UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error
 
 	return &user, nil
 }
+
+// GetAll returns a page of users whose email and name contain the given
+// substrings (case-insensitively). A nil activated matches users in any
+// activation state.
+func (m *UserModel) GetAll(email, name string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, deactivated_at IS NOT NULL, version
+	FROM users
+	WHERE (strpos(lower(email), lower($1)) > 0 OR $1 = '')
+	AND (strpos(lower(name), lower($2)) > 0 OR $2 = '')
+	AND ($3::boolean IS NULL OR activated = $3)
+	ORDER BY %s %s, id ASC
+	LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	totalRecords := 0
+	users := []*User{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	args := []interface{}{email, name, activated, filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Deactivated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if rows.Err() != nil {
+		return nil, Metadata{}, rows.Err()
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
@@ -0,0 +1,182 @@
+// Package jwt issues and verifies JSON Web Tokens signed with HMAC-SHA256
+// (HS256). Several keys can be configured at once so that signing keys can be
+// rotated: tokens name their key in the "kid" header, new tokens are always
+// signed with the current key, and tokens signed with older keys keep
+// verifying until those keys are removed.
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed        = errors.New("jwt: malformed token")
+	ErrUnknownKey       = errors.New("jwt: unknown signing key")
+	ErrInvalidSignature = errors.New("jwt: invalid signature")
+	ErrExpired          = errors.New("jwt: token has expired")
+)
+
+// MinSecretLength is the shortest secret accepted for a signing key.
+const MinSecretLength = 32
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+type Claims struct {
+	ID          string   `json:"jti"`
+	Subject     int64    `json:"sub"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	Name        string   `json:"name,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	Activated   bool     `json:"activated"`
+	Permissions []string `json:"permissions"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+type Signer struct {
+	current string
+	keys    map[string][]byte
+}
+
+// New returns a Signer that signs with the first key and verifies with any of
+// them.
+func New(keys []Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: at least one key is required")
+	}
+
+	s := &Signer{
+		current: keys[0].ID,
+		keys:    make(map[string][]byte, len(keys)),
+	}
+
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("jwt: key ID must not be empty")
+		}
+		if len(key.Secret) < MinSecretLength {
+			return nil, errors.New("jwt: key secret must be at least 32 bytes long")
+		}
+		if _, exists := s.keys[key.ID]; exists {
+			return nil, errors.New("jwt: duplicate key ID " + key.ID)
+		}
+		s.keys[key.ID] = key.Secret
+	}
+
+	return s, nil
+}
+
+// ParseKeys parses a space-separated list of "kid:secret" pairs.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+
+	for _, field := range strings.Fields(s) {
+		id, secret, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, errors.New("jwt: keys must be given as kid:secret")
+		}
+		keys = append(keys, Key{ID: id, Secret: []byte(secret)})
+	}
+
+	return keys, nil
+}
+
+func (s *Signer) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: "HS256", Type: "JWT", KeyID: s.current})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(h) + "." + encode(payload)
+
+	return signingInput + "." + encode(sign(s.keys[s.current], signingInput)), nil
+}
+
+// Verify checks the token's signature and expiry and returns its claims.
+func (s *Signer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	err := decode(parts[0], &h)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	// Only accept the algorithm we sign with, so that a token can't downgrade
+	// verification to "none" or to a different algorithm.
+	if h.Algorithm != "HS256" {
+		return nil, ErrMalformed
+	}
+
+	secret, ok := s.keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if !hmac.Equal(signature, sign(secret, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidSignature
+	}
+
+	var claims Claims
+	err = decode(parts[1], &claims)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+
+	return &claims, nil
+}
+
+// LooksLikeToken reports whether s has the three-part shape of a JWT, as
+// opposed to an opaque token.
+func LooksLikeToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+func sign(secret []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
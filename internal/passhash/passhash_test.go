@@ -0,0 +1,172 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, so the tests run quickly.
+var testParams = Params{
+	Algorithm:   Argon2id,
+	BcryptCost:  bcrypt.MinCost,
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+}
+
+// A $2a$ hash of "U*U" from the OpenBSD bcrypt test vectors.
+const bcryptVector = "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Bcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			p := testParams
+			p.Algorithm = algorithm
+
+			hash, err := Hash("pa55word", p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			match, err := Verify("pa55word", hash)
+			if err != nil || !match {
+				t.Errorf("Verify(correct password) = %v, %v; want true, nil", match, err)
+			}
+
+			match, err = Verify("pa55wore", hash)
+			if err != nil || match {
+				t.Errorf("Verify(wrong password) = %v, %v; want false, nil", match, err)
+			}
+		})
+	}
+}
+
+func TestHashFormat(t *testing.T) {
+	hash, err := Hash("pa55word", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prefix := "$argon2id$v=19$m=64,t=1,p=1$"; !strings.HasPrefix(string(hash), prefix) {
+		t.Errorf("hash %s doesn't start with %s", hash, prefix)
+	}
+
+	other, err := Hash("pa55word", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(hash) == string(other) {
+		t.Error("hashes of the same password are equal; salt not random")
+	}
+}
+
+func TestVerifyBcrypt2a(t *testing.T) {
+	match, err := Verify("U*U", []byte(bcryptVector))
+	if err != nil || !match {
+		t.Errorf("Verify(correct password) = %v, %v; want true, nil", match, err)
+	}
+
+	match, err = Verify("U*V", []byte(bcryptVector))
+	if err != nil || match {
+		t.Errorf("Verify(wrong password) = %v, %v; want false, nil", match, err)
+	}
+
+	// bcrypt ignores anything past 72 bytes, so longer passwords never match
+	// rather than matching on their prefix.
+	long := strings.Repeat("a", BcryptMaxLength)
+	hash, err := bcrypt.GenerateFromPassword([]byte(long), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match, err = Verify(long+"b", hash)
+	if err != nil || match {
+		t.Errorf("Verify(over-long password) = %v, %v; want false, nil", match, err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+	} {
+		_, err := Verify("pa55word", []byte(hash))
+		if !errors.Is(err, ErrMalformedHash) {
+			t.Errorf("Verify(%q) error = %v; want ErrMalformedHash", hash, err)
+		}
+	}
+
+	_, err := Verify("pa55word", []byte("not a hash"))
+	if err == nil {
+		t.Error("Verify of a garbage hash returned no error")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon2Hash, err := Hash("pa55word", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(change func(p *Params)) Params {
+		p := testParams
+		change(&p)
+		return p
+	}
+
+	tests := []struct {
+		name string
+		hash []byte
+		p    Params
+		want bool
+	}{
+		{"argon2id current", argon2Hash, testParams, false},
+		{"argon2id memory changed", argon2Hash, with(func(p *Params) { p.Memory = 128 }), true},
+		{"argon2id iterations changed", argon2Hash, with(func(p *Params) { p.Iterations = 2 }), true},
+		{"argon2id parallelism changed", argon2Hash, with(func(p *Params) { p.Parallelism = 2 }), true},
+		{"argon2id to bcrypt", argon2Hash, with(func(p *Params) { p.Algorithm = Bcrypt }), true},
+		{"bcrypt to argon2id", []byte(bcryptVector), testParams, true},
+		{"bcrypt current", []byte(bcryptVector), with(func(p *Params) { p.Algorithm = Bcrypt; p.BcryptCost = 5 }), false},
+		{"bcrypt cost changed", []byte(bcryptVector), with(func(p *Params) { p.Algorithm = Bcrypt; p.BcryptCost = 12 }), true},
+		{"malformed argon2id", []byte("$argon2id$v=19$garbage"), testParams, true},
+		{"malformed bcrypt", []byte("garbage"), with(func(p *Params) { p.Algorithm = Bcrypt }), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NeedsRehash(tt.hash, tt.p); got != tt.want {
+				t.Errorf("NeedsRehash() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       Params
+		wantErr bool
+	}{
+		{"defaults", DefaultParams, false},
+		{"bcrypt", Params{Algorithm: Bcrypt, BcryptCost: 12}, false},
+		{"bcrypt cost too low", Params{Algorithm: Bcrypt, BcryptCost: 3}, true},
+		{"bcrypt cost too high", Params{Algorithm: Bcrypt, BcryptCost: 32}, true},
+		{"no iterations", Params{Algorithm: Argon2id, Memory: 64, Parallelism: 1}, true},
+		{"no parallelism", Params{Algorithm: Argon2id, Memory: 64, Iterations: 1}, true},
+		{"too little memory", Params{Algorithm: Argon2id, Memory: 15, Iterations: 1, Parallelism: 2}, true},
+		{"unknown algorithm", Params{Algorithm: "md5"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v; want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package passpolicy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// hashLength is the length of a hex encoded SHA-1 hash.
+const hashLength = 40
+
+// maxLineLength bounds the lines of a hash file: a hash, a colon and a count.
+const maxLineLength = 128
+
+// HashFile is a file of breached password hashes, such as the "ordered by hash"
+// SHA-1 download from Have I Been Pwned. Each line holds an uppercase hex
+// SHA-1 hash, optionally followed by a colon and a count, and the lines are
+// sorted. Lookups binary search the file on disk, so it can be far larger than
+// memory.
+type HashFile struct {
+	file *os.File
+	size int64
+}
+
+// OpenHashFile opens a hash file and checks that its first line looks right.
+func OpenHashFile(path string) (*HashFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	h := &HashFile{file: file, size: info.Size()}
+
+	line, err := h.lineAt(0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !validHash(line) {
+		file.Close()
+		return nil, fmt.Errorf("passpolicy: %s is not a sorted SHA-1 hash file", path)
+	}
+
+	return h, nil
+}
+
+func (h *HashFile) Close() error {
+	return h.file.Close()
+}
+
+// Contains reports whether the password's hash is in the file. A file that
+// can't be read counts as not containing it, so that a disk problem doesn't
+// stop anyone from setting a password.
+func (h *HashFile) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// lo and hi bound the offsets at which the target's line could start.
+	lo, hi := int64(0), h.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, err := h.lineStart(mid)
+		if err != nil {
+			return false
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		line, err := h.lineAt(start)
+		if err != nil || len(line) < hashLength {
+			return false
+		}
+
+		switch hash := string(line[:hashLength]); {
+		case hash == target:
+			return true
+		case hash < target:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return false
+}
+
+// lineStart returns the offset of the first line starting at or after pos.
+func (h *HashFile) lineStart(pos int64) (int64, error) {
+	for pos > 0 && pos < h.size {
+		buf := make([]byte, maxLineLength)
+
+		n, err := h.file.ReadAt(buf, pos-1)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i), nil
+		}
+		pos += int64(n)
+	}
+
+	return pos, nil
+}
+
+// lineAt returns the line starting at the offset, without its line ending.
+func (h *HashFile) lineAt(start int64) ([]byte, error) {
+	buf := make([]byte, maxLineLength)
+
+	n, err := h.file.ReadAt(buf, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	line := buf[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	return bytes.TrimRight(line, "\r"), nil
+}
+
+func validHash(line []byte) bool {
+	if len(line) < hashLength {
+		return false
+	}
+	if len(line) > hashLength && line[hashLength] != ':' {
+		return false
+	}
+	for _, c := range line[:hashLength] {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package passpolicy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var breached = []string{"password", "123456", "qwerty", "letmein", "dragon", "monkey", "sunshine"}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeHashFile writes a sorted hash file of the passwords with the given line
+// ending and returns the passwords in file order.
+func writeHashFile(t *testing.T, passwords []string, eol string, trailingNewline bool) (string, []string) {
+	t.Helper()
+
+	sorted := append([]string{}, passwords...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sha1Hex(sorted[i]) < sha1Hex(sorted[j])
+	})
+
+	lines := make([]string, len(sorted))
+	for i, password := range sorted {
+		lines[i] = fmt.Sprintf("%s:%d", sha1Hex(password), i+1)
+	}
+
+	content := strings.Join(lines, eol)
+	if trailingNewline {
+		content += eol
+	}
+
+	path := filepath.Join(t.TempDir(), "hashes.txt")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, sorted
+}
+
+func TestHashFileContains(t *testing.T) {
+	tests := []struct {
+		name            string
+		eol             string
+		trailingNewline bool
+	}{
+		{"LF", "\n", true},
+		{"CRLF", "\r\n", true},
+		{"no trailing newline", "\n", false},
+		{"CRLF without trailing newline", "\r\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, sorted := writeHashFile(t, breached, tt.eol, tt.trailingNewline)
+
+			h, err := OpenHashFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			if !h.Contains(sorted[0]) {
+				t.Errorf("first line %q not found", sorted[0])
+			}
+			if last := sorted[len(sorted)-1]; !h.Contains(last) {
+				t.Errorf("last line %q not found", last)
+			}
+			for _, password := range sorted {
+				if !h.Contains(password) {
+					t.Errorf("%q not found", password)
+				}
+			}
+
+			for _, password := range []string{"correct horse battery staple", "", "Password"} {
+				if h.Contains(password) {
+					t.Errorf("%q found but isn't in the file", password)
+				}
+			}
+		})
+	}
+}
+
+func TestHashFileContainsLarge(t *testing.T) {
+	var passwords []string
+	for i := 0; i < 5000; i += 2 {
+		passwords = append(passwords, fmt.Sprintf("password%d", i))
+	}
+
+	path, _ := writeHashFile(t, passwords, "\n", true)
+
+	h, err := OpenHashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 5000; i++ {
+		password := fmt.Sprintf("password%d", i)
+		if got, want := h.Contains(password), i%2 == 0; got != want {
+			t.Errorf("Contains(%q) = %v; want %v", password, got, want)
+		}
+	}
+}
+
+func TestHashFileSingleLine(t *testing.T) {
+	path, _ := writeHashFile(t, []string{"password"}, "\n", false)
+
+	h, err := OpenHashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if !h.Contains("password") {
+		t.Error("only line not found")
+	}
+	if h.Contains("123456") {
+		t.Error("missing hash found")
+	}
+}
+
+func TestOpenHashFileInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":     "",
+		"lowercase": strings.ToLower(sha1Hex("password")) + "\n",
+		"text":      "not a hash file\n",
+		"bad count": sha1Hex("password") + " 12\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hashes.txt")
+			err := os.WriteFile(path, []byte(content), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h, err := OpenHashFile(path)
+			if err == nil {
+				h.Close()
+				t.Error("OpenHashFile returned no error")
+			}
+		})
+	}
+}
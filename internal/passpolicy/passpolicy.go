@@ -0,0 +1,83 @@
+// Package passpolicy decides whether a new password is acceptable: long enough,
+// not based on the user's own details and not a known common or breached
+// password. Breached passwords are looked up in a local file, never over the
+// network.
+package passpolicy
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:embed common.txt
+var commonFile string
+
+// common holds the bundled common passwords, lowercased.
+var common = parseList(commonFile)
+
+// Policy is the set of rules new passwords must follow.
+type Policy struct {
+	MinLength int
+	// Breached is an optional file of breached password hashes.
+	Breached *HashFile
+}
+
+// TooShort reports whether the password has fewer than MinLength characters.
+func (p Policy) TooShort(password string) bool {
+	return utf8.RuneCountInString(password) < p.MinLength
+}
+
+// IsCommon reports whether the password is on the bundled list of common
+// passwords or in the breached password file.
+func (p Policy) IsCommon(password string) bool {
+	if _, found := common[strings.ToLower(password)]; found {
+		return true
+	}
+	return p.Breached != nil && p.Breached.Contains(password)
+}
+
+// ContainsPersonal reports whether the password contains any of the user's
+// details, such as their name or email address, or a word of them at least
+// four characters long. For "Jane Doe" and "jane.doe@example.com" that rules
+// out passwords containing "jane", but not "doe" or "example".
+func ContainsPersonal(password string, details ...string) bool {
+	password = strings.ToLower(password)
+
+	for _, detail := range details {
+		detail = strings.ToLower(detail)
+		if utf8.RuneCountInString(detail) >= 4 && strings.Contains(password, detail) {
+			return true
+		}
+
+		// The domain of an email address says nothing about its owner.
+		local, _, _ := strings.Cut(detail, "@")
+
+		words := strings.FieldsFunc(local, func(r rune) bool {
+			return strings.ContainsRune(" ._-+", r)
+		})
+		for _, word := range words {
+			if utf8.RuneCountInString(word) >= 4 && strings.Contains(password, word) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func parseList(s string) map[string]struct{} {
+	list := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[strings.ToLower(line)] = struct{}{}
+	}
+
+	return list
+}
@@ -0,0 +1,89 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// 1 January 2024 was a Monday.
+	at := func(month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(2024, month, day, hour, min, sec, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", at(1, 1, 10, 7, 30), at(1, 1, 10, 8, 0)},
+		{"strictly after", "* * * * *", at(1, 1, 10, 7, 0), at(1, 1, 10, 8, 0)},
+		{"list", "5,35 * * * *", at(1, 1, 10, 6, 0), at(1, 1, 10, 35, 0)},
+		{"step", "*/15 * * * *", at(1, 1, 10, 7, 0), at(1, 1, 10, 15, 0)},
+		{"step wraps hour", "*/15 * * * *", at(1, 1, 10, 45, 0), at(1, 1, 11, 0, 0)},
+		{"range with step", "0-30/10 * * * *", at(1, 1, 10, 31, 0), at(1, 1, 11, 0, 0)},
+		{"value with step", "20/20 * * * *", at(1, 1, 10, 21, 0), at(1, 1, 10, 40, 0)},
+		{"range", "10-12 * * * *", at(1, 1, 10, 12, 0), at(1, 1, 11, 10, 0)},
+		{"weekdays", "0 9 * * 1-5", at(1, 5, 10, 0, 0), at(1, 8, 9, 0, 0)},
+		{"sunday as 0", "0 0 * * 0", at(1, 1, 0, 0, 0), at(1, 7, 0, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", at(1, 1, 0, 0, 0), at(1, 7, 0, 0, 0)},
+		{"range to 7", "0 0 * * 6-7", at(1, 1, 0, 0, 0), at(1, 6, 0, 0, 0)},
+		{"day of month", "0 0 13 * *", at(1, 1, 0, 0, 0), at(1, 13, 0, 0, 0)},
+		{"day fields or day of week", "0 0 13 * 5", at(1, 1, 0, 0, 0), at(1, 5, 0, 0, 0)},
+		{"day fields or day of month", "0 0 13 * 5", at(1, 12, 0, 0, 0), at(1, 13, 0, 0, 0)},
+		{"month rollover", "0 0 1 * *", at(12, 15, 0, 0, 0), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", at(3, 1, 0, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"hourly", "@hourly", at(1, 1, 10, 7, 0), at(1, 1, 11, 0, 0)},
+		{"weekly", "@weekly", at(1, 1, 0, 0, 0), at(1, 7, 0, 0, 0)},
+		{"every", "@every 90m", at(1, 1, 10, 7, 30), at(1, 1, 11, 37, 30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned error: %v", tt.spec, err)
+			}
+
+			got := s.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v; want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+	}{
+		{"empty", ""},
+		{"too few fields", "* * * *"},
+		{"too many fields", "* * * * * *"},
+		{"unknown descriptor", "@fortnightly"},
+		{"minute out of range", "60 * * * *"},
+		{"hour out of range", "* 24 * * *"},
+		{"day of month zero", "* * 0 * *"},
+		{"month out of range", "* * * 13 *"},
+		{"day of week out of range", "* * * * 8"},
+		{"reversed range", "5-1 * * * *"},
+		{"zero step", "*/0 * * * *"},
+		{"not a number", "a * * * *"},
+		{"31 February", "0 0 31 2 *"},
+		{"31 April", "0 0 31 4 *"},
+		{"zero interval", "@every 0s"},
+		{"interval below a second", "@every 500ms"},
+		{"invalid interval", "@every soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.spec)
+			if err == nil {
+				t.Errorf("Parse(%q) returned no error", tt.spec)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from RFC 6238, Appendix B.
+var rfcKey = []byte("12345678901234567890")
+
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestHOTP(t *testing.T) {
+	for _, tt := range rfcVectors {
+		got := HOTP(rfcKey, uint64(tt.unix/Period), 8)
+		if got != tt.code {
+			t.Errorf("HOTP at %d = %s; want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	for _, tt := range rfcVectors {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A 6 digit code is the last 6 digits of the 8 digit one.
+		if want := tt.code[2:]; got != want {
+			t.Errorf("Code at %d = %s; want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Counter(now)
+
+	codeAt := func(offset int64) string {
+		return HOTP(rfcKey, uint64(step+offset), Digits)
+	}
+
+	tests := []struct {
+		name        string
+		code        string
+		secret      string
+		skew        int
+		wantCounter int64
+		wantOK      bool
+	}{
+		{"current step", codeAt(0), rfcSecret, 1, step, true},
+		{"no skew", codeAt(0), rfcSecret, 0, step, true},
+		{"previous step within skew", codeAt(-1), rfcSecret, 1, step - 1, true},
+		{"next step within skew", codeAt(1), rfcSecret, 1, step + 1, true},
+		{"previous step without skew", codeAt(-1), rfcSecret, 0, 0, false},
+		{"beyond skew in the past", codeAt(-2), rfcSecret, 1, 0, false},
+		{"beyond skew in the future", codeAt(2), rfcSecret, 1, 0, false},
+		{"surrounding whitespace", " " + codeAt(0) + "\n", rfcSecret, 1, step, true},
+		{"lowercase spaced secret", codeAt(0), "gezd gnbv gy3t qojq gezd gnbv gy3t qojq", 1, step, true},
+		{"padded secret", codeAt(0), rfcSecret + "====", 1, step, true},
+		{"wrong code", "000000", rfcSecret, 1, 0, false},
+		{"too short", codeAt(0)[1:], rfcSecret, 1, 0, false},
+		{"too long", codeAt(0) + "0", rfcSecret, 1, 0, false},
+		{"empty", "", rfcSecret, 1, 0, false},
+		{"malformed secret", codeAt(0), "not base32!", 1, 0, false},
+		{"empty secret", codeAt(0), "", 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok := Validate(tt.code, tt.secret, now, tt.skew)
+			if counter != tt.wantCounter || ok != tt.wantOK {
+				t.Errorf("Validate(%q) = %d, %v; want %d, %v", tt.code, counter, ok, tt.wantCounter, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateNearEpoch(t *testing.T) {
+	// Time steps before the epoch are skipped rather than wrapping around.
+	code := HOTP(rfcKey, 0, Digits)
+
+	counter, ok := Validate(code, rfcSecret, time.Unix(10, 0), 1)
+	if !ok || counter != 0 {
+		t.Errorf("Validate = %d, %v; want 0, true", counter, ok)
+	}
+}
+
+// Callers reject replays by only accepting a time step later than the last one
+// used (see data.TOTPModel.UseCounter), which relies on Validate reporting the
+// step the code belongs to rather than the current one.
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code := HOTP(rfcKey, uint64(Counter(now)), Digits)
+
+	lastUsed := int64(-1)
+	use := func(at time.Time) bool {
+		counter, ok := Validate(code, rfcSecret, at, 1)
+		if !ok || counter <= lastUsed {
+			return false
+		}
+		lastUsed = counter
+		return true
+	}
+
+	if !use(now) {
+		t.Fatal("first use rejected")
+	}
+	if use(now) {
+		t.Error("replay in the same time step accepted")
+	}
+	if use(now.Add(Period * time.Second)) {
+		t.Error("replay in the next time step accepted")
+	}
+
+	earlier := HOTP(rfcKey, uint64(Counter(now)-1), Digits)
+	if counter, ok := Validate(earlier, rfcSecret, now, 1); !ok || counter > lastUsed {
+		t.Errorf("Validate of an earlier code = %d, %v; want a step before %d", counter, ok, lastUsed)
+	}
+}
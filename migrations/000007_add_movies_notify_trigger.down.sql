@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS movies_notify_invalidation ON movies;
+DROP FUNCTION IF EXISTS notify_movie_invalidation();
@@ -0,0 +1,10 @@
+CREATE OR REPLACE FUNCTION notify_movie_invalidation() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('movie_invalidations', OLD.id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_notify_invalidation
+AFTER UPDATE OR DELETE ON movies
+FOR EACH ROW EXECUTE FUNCTION notify_movie_invalidation();
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS users_permissions_notify_auth_invalidation ON users_permissions;
+DROP TRIGGER IF EXISTS tokens_notify_auth_invalidation ON tokens;
+DROP TRIGGER IF EXISTS users_notify_auth_invalidation ON users;
+DROP FUNCTION IF EXISTS notify_auth_invalidation();
@@ -0,0 +1,28 @@
+CREATE OR REPLACE FUNCTION notify_auth_invalidation() RETURNS trigger AS $$
+DECLARE
+    affected_user_id bigint;
+BEGIN
+    IF TG_TABLE_NAME = 'users' THEN
+        affected_user_id := OLD.id;
+    ELSIF TG_OP = 'INSERT' THEN
+        affected_user_id := NEW.user_id;
+    ELSE
+        affected_user_id := OLD.user_id;
+    END IF;
+
+    PERFORM pg_notify('auth_invalidations', affected_user_id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_notify_auth_invalidation
+AFTER UPDATE OR DELETE ON users
+FOR EACH ROW EXECUTE FUNCTION notify_auth_invalidation();
+
+CREATE TRIGGER tokens_notify_auth_invalidation
+AFTER UPDATE OR DELETE ON tokens
+FOR EACH ROW EXECUTE FUNCTION notify_auth_invalidation();
+
+CREATE TRIGGER users_permissions_notify_auth_invalidation
+AFTER INSERT OR DELETE ON users_permissions
+FOR EACH ROW EXECUTE FUNCTION notify_auth_invalidation();
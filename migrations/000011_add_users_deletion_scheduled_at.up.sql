@@ -0,0 +1,10 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at timestamp(0) with time zone;
+
+-- Every table holding personal data must reference users with ON DELETE CASCADE
+-- so that hard-deleting a user leaves nothing behind. That is tokens (000005),
+-- users_permissions (000006), users_roles (000013), movie_collaborators (000015),
+-- api_keys (000019), users_totp and recovery_codes (000020), and oauth_clients
+-- and oauth_codes (000021). movies.created_by (000015) is set to NULL instead,
+-- as movies are shared. login_attempts (000022) and audit_events (000023) have
+-- no foreign key: old login attempts are removed by the purge_expired_tokens
+-- job, and the purge_audit_events job pseudonymises the events of deleted users.
@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- The default role for new registrations grants what used to be added directly.
+INSERT INTO roles (name)
+VALUES
+    ('reader');
+
+INSERT INTO role_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'reader' AND permissions.code = 'movies:read';
+
+CREATE TRIGGER users_roles_notify_auth_invalidation
+AFTER INSERT OR DELETE ON users_roles
+FOR EACH ROW EXECUTE FUNCTION notify_auth_invalidation();
+
+-- A change to a role's permissions affects every user holding the role, so all
+-- cached permissions are dropped.
+CREATE OR REPLACE FUNCTION notify_auth_purge() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('auth_invalidations', '*');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER role_permissions_notify_auth_purge
+AFTER INSERT OR DELETE ON role_permissions
+FOR EACH STATEMENT EXECUTE FUNCTION notify_auth_purge();
@@ -0,0 +1,15 @@
+-- Movies are shared catalogue entries, so deleting a user only removes the link
+-- to them rather than the movies themselves.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+CREATE TABLE IF NOT EXISTS movie_collaborators (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    PRIMARY KEY (movie_id, user_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:write:own');
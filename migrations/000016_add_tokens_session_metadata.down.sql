@@ -0,0 +1,11 @@
+DROP TRIGGER IF EXISTS tokens_notify_auth_invalidation ON tokens;
+
+CREATE TRIGGER tokens_notify_auth_invalidation
+AFTER UPDATE OR DELETE ON tokens
+FOR EACH ROW EXECUTE FUNCTION notify_auth_invalidation();
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE tokens DROP COLUMN IF EXISTS ip;
+ALTER TABLE tokens DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
+ALTER TABLE tokens DROP COLUMN IF EXISTS id;
@@ -0,0 +1,13 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial UNIQUE;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+
+-- Tokens are now updated whenever they are used, which must not invalidate the
+-- authentication caches. Only deleting a token does.
+DROP TRIGGER IF EXISTS tokens_notify_auth_invalidation ON tokens;
+
+CREATE TRIGGER tokens_notify_auth_invalidation
+AFTER DELETE ON tokens
+FOR EACH ROW EXECUTE FUNCTION notify_auth_invalidation();
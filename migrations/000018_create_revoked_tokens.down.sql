@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS revoked_tokens_notify_revocation ON revoked_tokens;
+DROP FUNCTION IF EXISTS notify_token_revocation();
+DROP TABLE IF EXISTS revoked_tokens;
@@ -0,0 +1,23 @@
+-- Denylist for stateless (signed) access tokens, which are otherwise valid
+-- until they expire. A row either revokes a single token by its jti, or, when
+-- jti is NULL, every token issued to the user before revoked_at.
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    id bigserial PRIMARY KEY,
+    jti text,
+    user_id bigint NOT NULL,
+    revoked_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_expiry_idx ON revoked_tokens (expiry);
+
+CREATE OR REPLACE FUNCTION notify_token_revocation() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('token_revocations', NEW.id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER revoked_tokens_notify_revocation
+AFTER INSERT ON revoked_tokens
+FOR EACH ROW EXECUTE FUNCTION notify_token_revocation();
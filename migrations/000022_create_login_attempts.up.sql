@@ -0,0 +1,12 @@
+-- Failed logins, kept for brute-force protection. Attempts are recorded by
+-- email whether or not an account exists, so that lockouts can't be used to
+-- discover which addresses are registered.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id bigserial PRIMARY KEY,
+    email citext NOT NULL,
+    ip text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_email_idx ON login_attempts (email, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
@@ -0,0 +1,14 @@
+-- activated_at records when the account was first activated and is never
+-- cleared, so that accounts deactivated by an admin can be told apart from ones
+-- that were never activated.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at timestamp(0) with time zone;
+
+-- The activation time of existing accounts isn't known, so their creation time
+-- stands in for it. Deactivated accounts are recognised by their audit events.
+UPDATE users SET activated_at = created_at
+WHERE activated_at IS NULL AND (
+    activated OR id IN (
+        SELECT subject_id FROM audit_events
+        WHERE type IN ('user_activated', 'user_deactivated')
+    )
+);
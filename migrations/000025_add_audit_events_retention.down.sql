@@ -0,0 +1,7 @@
+DROP FUNCTION IF EXISTS purge_audit_events(timestamp with time zone);
+
+CREATE OR REPLACE FUNCTION reject_audit_event_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
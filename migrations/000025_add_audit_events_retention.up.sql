@@ -0,0 +1,44 @@
+-- Audit events stay append-only for the application, but can be removed or
+-- pseudonymised by purge_audit_events(), which is run by the purge_audit_events
+-- job. Only that function enables the greenlight.audit_retention setting, and
+-- only for the duration of its own transaction. The setting guards against
+-- accidental changes; it doesn't stop a database user who sets it on purpose.
+CREATE OR REPLACE FUNCTION reject_audit_event_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP <> 'TRUNCATE' AND current_setting('greenlight.audit_retention', true) = 'on' THEN
+        IF TG_OP = 'DELETE' THEN
+            RETURN OLD;
+        END IF;
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+-- purge_audit_events deletes the events created before cutoff, and strips the
+-- IP address, user agent and any email addresses from the remaining events of
+-- users that no longer exist. It returns the number of events affected.
+CREATE OR REPLACE FUNCTION purge_audit_events(cutoff timestamp with time zone) RETURNS bigint AS $$
+DECLARE
+    deleted bigint;
+    pseudonymised bigint;
+BEGIN
+    PERFORM set_config('greenlight.audit_retention', 'on', true);
+
+    DELETE FROM audit_events WHERE created_at < cutoff;
+    GET DIAGNOSTICS deleted = ROW_COUNT;
+
+    UPDATE audit_events
+    SET ip = '', user_agent = '', details = details - ARRAY['email', 'old_email', 'new_email']
+    WHERE (ip <> '' OR user_agent <> '' OR details ?| ARRAY['email', 'old_email', 'new_email'])
+    AND (
+        (actor_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM users WHERE users.id = actor_id)) OR
+        (subject_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM users WHERE users.id = subject_id))
+    );
+    GET DIAGNOSTICS pseudonymised = ROW_COUNT;
+
+    PERFORM set_config('greenlight.audit_retention', 'off', true);
+
+    RETURN deleted + pseudonymised;
+END;
+$$ LANGUAGE plpgsql;
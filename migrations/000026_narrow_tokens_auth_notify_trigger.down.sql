@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS tokens_notify_auth_invalidation ON tokens;
+
+CREATE TRIGGER tokens_notify_auth_invalidation
+AFTER DELETE ON tokens
+FOR EACH ROW EXECUTE FUNCTION notify_auth_invalidation();
+
+DROP FUNCTION IF EXISTS notify_tokens_auth_invalidation();
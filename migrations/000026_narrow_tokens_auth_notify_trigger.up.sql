@@ -0,0 +1,37 @@
+-- Deleting tokens used to send one notification per row, so a bulk delete such
+-- as the expired-token cleanup made every instance scan its authentication
+-- cache once for each deleted token. The trigger now runs once per statement
+-- and notifies each affected user once. Expired tokens are skipped, since the
+-- cache already rejects them, and a large delete invalidates every user with a
+-- single notification instead.
+CREATE OR REPLACE FUNCTION notify_tokens_auth_invalidation() RETURNS trigger AS $$
+DECLARE
+    affected_user_ids bigint[];
+    affected_user_id bigint;
+BEGIN
+    SELECT array_agg(DISTINCT user_id) INTO affected_user_ids
+    FROM deleted_tokens
+    WHERE expiry >= NOW();
+
+    IF affected_user_ids IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    IF cardinality(affected_user_ids) > 100 THEN
+        PERFORM pg_notify('auth_invalidations', '*');
+        RETURN NULL;
+    END IF;
+
+    FOREACH affected_user_id IN ARRAY affected_user_ids LOOP
+        PERFORM pg_notify('auth_invalidations', affected_user_id::text);
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tokens_notify_auth_invalidation ON tokens;
+
+CREATE TRIGGER tokens_notify_auth_invalidation
+AFTER DELETE ON tokens
+REFERENCING OLD TABLE AS deleted_tokens
+FOR EACH STATEMENT EXECUTE FUNCTION notify_tokens_auth_invalidation();
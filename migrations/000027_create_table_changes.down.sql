@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS movies_record_table_change ON movies;
+DROP FUNCTION IF EXISTS record_table_change();
+DROP TABLE IF EXISTS table_changes;
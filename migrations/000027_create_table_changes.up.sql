@@ -0,0 +1,22 @@
+-- table_changes records when each tracked table was last written to, including
+-- deletes, which leave no trace in the remaining rows. It backs the
+-- Last-Modified date of list responses.
+CREATE TABLE IF NOT EXISTS table_changes (
+    table_name text PRIMARY KEY,
+    changed_at timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO table_changes (table_name) VALUES ('movies') ON CONFLICT DO NOTHING;
+
+CREATE OR REPLACE FUNCTION record_table_change() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO table_changes (table_name, changed_at)
+    VALUES (TG_TABLE_NAME, clock_timestamp())
+    ON CONFLICT (table_name) DO UPDATE SET changed_at = EXCLUDED.changed_at;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_record_table_change
+AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON movies
+FOR EACH STATEMENT EXECUTE FUNCTION record_table_change();
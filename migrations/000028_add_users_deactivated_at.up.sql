@@ -0,0 +1,14 @@
+-- deactivated_at is set while an admin has deactivated the account. Unlike
+-- activated, it can't be changed by the user, so a deactivated account can't
+-- be activated again with a new activation token.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at timestamp(0) with time zone;
+
+-- Existing accounts that are deactivated and were last deactivated rather than
+-- activated, according to the audit log, stay deactivated.
+UPDATE users SET deactivated_at = NOW()
+WHERE NOT activated AND deactivated_at IS NULL AND (
+    SELECT type FROM audit_events
+    WHERE subject_id = users.id AND type IN ('user_activated', 'user_deactivated')
+    ORDER BY created_at DESC, id DESC
+    LIMIT 1
+) = 'user_deactivated';